@@ -0,0 +1,89 @@
+package vastflow
+
+import (
+	"fmt"
+	"runtime"
+	"sync/atomic"
+)
+
+// Admission decides if this unit takes one more job. It's asked serially with the window
+// locked before a job is claimed, running is the number of jobs running in this unit.
+// A non-nil error refuses the job and is returned by the fetch.
+type Admission interface {
+	Admit(running int64) error
+}
+
+// SetAdmission replaces the admission of the default engine, nil restores the cpu window
+func SetAdmission(admission Admission) {
+	defaultEngine.SetAdmission(admission)
+}
+
+func (e *Engine) SetAdmission(admission Admission) {
+	e.wnd.Lock()
+	defer e.wnd.Unlock()
+	e.admission = admission
+}
+
+// admit must be called with the window locked
+func (e *Engine) admit() error {
+	if e.admission == nil {
+		return e.wnd.Admit(e.wnd.CurSize)
+	}
+	return e.admission.Admit(e.wnd.CurSize)
+}
+
+// GoroutineAdmission refuses jobs while the process runs MaxGoroutines or more goroutines
+type GoroutineAdmission struct {
+	MaxGoroutines int
+}
+
+func (ga *GoroutineAdmission) Admit(running int64) error {
+	if n := runtime.NumGoroutine(); n >= ga.MaxGoroutines {
+		return fmt.Errorf("too many goroutines, num:%d, max:%d", n, ga.MaxGoroutines)
+	}
+	return nil
+}
+
+// MemoryAdmission refuses jobs while heap in use reaches MaxHeapBytes
+type MemoryAdmission struct {
+	MaxHeapBytes uint64
+}
+
+func (ma *MemoryAdmission) Admit(running int64) error {
+	var ms runtime.MemStats
+	runtime.ReadMemStats(&ms)
+	if ms.HeapInuse >= ma.MaxHeapBytes {
+		return fmt.Errorf("heap in use too much, bytes:%d, max:%d", ms.HeapInuse, ma.MaxHeapBytes)
+	}
+	return nil
+}
+
+// ExternalCallAdmission refuses jobs while MaxCalls or more external calls are in flight,
+// it suits rivers mostly waiting on remote apis. Rivers bracket the calls with
+// BeginExternalCall and EndExternalCall.
+type ExternalCallAdmission struct {
+	MaxCalls int64
+
+	calls int64
+}
+
+func (ea *ExternalCallAdmission) BeginExternalCall() {
+	atomic.AddInt64(&ea.calls, 1)
+}
+
+func (ea *ExternalCallAdmission) EndExternalCall() {
+	if atomic.AddInt64(&ea.calls, -1) < 0 {
+		atomic.StoreInt64(&ea.calls, 0)
+	}
+}
+
+func (ea *ExternalCallAdmission) InFlight() int64 {
+	return atomic.LoadInt64(&ea.calls)
+}
+
+func (ea *ExternalCallAdmission) Admit(running int64) error {
+	if n := ea.InFlight(); n >= ea.MaxCalls {
+		return fmt.Errorf("too many external calls in flight, num:%d, max:%d", n, ea.MaxCalls)
+	}
+	return nil
+}
@@ -4,15 +4,30 @@ import (
 	"errors"
 	"github.com/jack0liu/logs"
 	"reflect"
+	"time"
 )
 
 type Andes struct {
 	headwaters *Headwaters
 	first      Stream
 	last       Stream
+	engine     *Engine
+
+	parentFlowId string // child river started the andes
+}
+
+func (an *Andes) eng() *Engine {
+	if an.engine == nil {
+		return defaultEngine
+	}
+	return an.engine
 }
 
 func (an *Andes) Start() (id string, err error) {
+	e := an.eng()
+	if e.isShuttingDown() {
+		return "", ErrorShutdown
+	}
 	if an.first == nil {
 		return "", errors.New("no river can run")
 	}
@@ -23,15 +38,23 @@ func (an *Andes) Start() (id string, err error) {
 	if an.headwaters.atlantic == nil {
 		return "", errors.New("no atlantic can't run")
 	}
-	rootId, err := saveDraw(an, stateInit)
+	an.headwaters.first = an.first
+	an.bindJob()
+	rootId, err := e.saveDraw(an, stateInit)
 	if err != nil {
 		return "", err
 	}
-	go an.first.Run(an.headwaters, an.first.(RiverFlow), false)
+	an.armDeadline()
+	an.watchCancel()
+	e.goRun(an.first, an.headwaters, false)
 	return rootId, nil
 }
 
 func (an *Andes) ReStart() error {
+	e := an.eng()
+	if e.isShuttingDown() {
+		return ErrorShutdown
+	}
 	if an.first == nil {
 		return errors.New("no river can run")
 	}
@@ -42,7 +65,11 @@ func (an *Andes) ReStart() error {
 	if an.headwaters.atlantic == nil {
 		return errors.New("no atlantic can't run")
 	}
-	go an.first.Run(an.headwaters, an.first.(RiverFlow), false)
+	an.headwaters.first = an.first
+	an.bindJob()
+	an.armDeadline()
+	an.watchCancel()
+	e.goRun(an.first, an.headwaters, false)
 	return nil
 }
 
@@ -51,7 +78,7 @@ func (an *Andes) GetHeadwaters() *Headwaters {
 }
 
 func (an *Andes) DrawStream(river Stream) *Andes {
-	if _, ok := river.(RiverFlow); !ok {
+	if riverFlowOf(river) == nil {
 		panic("river not implement RiverFlow")
 	}
 	if an.first == nil {
@@ -70,6 +97,9 @@ func (an *Andes) DrawStream(river Stream) *Andes {
 }
 
 func (an *Andes) DrawHeadWaters(waters *Headwaters) *Andes {
+	if waters != nil {
+		waters.engine = an.eng()
+	}
 	an.headwaters = waters
 	return an
 }
@@ -78,17 +108,138 @@ func (an *Andes) DrawAtlantic(atlantic AtlanticStream) *Andes {
 	if an.headwaters == nil {
 		panic("headwaters not set")
 	}
-	if _, ok := atlantic.(AtlanticFlow); !ok {
+	if atlanticFlowOf(atlantic) == nil {
 		panic("atlantic not implement AtlanticFlow")
 	}
 	an.headwaters.atlantic = atlantic
 	return an
 }
 
+// DrawDeadline bounds the whole andes, rivers still running at the deadline are canceled
+// and the atlantic fails with ErrorDeadline
+func (an *Andes) DrawDeadline(deadline time.Time) *Andes {
+	if an.headwaters == nil {
+		panic("headwaters not set")
+	}
+	an.headwaters.SetDeadline(deadline)
+	return an
+}
+
+func (an *Andes) DrawTimeout(timeout time.Duration) *Andes {
+	return an.DrawDeadline(time.Now().UTC().Add(timeout))
+}
+
+// bindJob takes the fencing token of job owned by this unit, and the deadline submitted
+// with the job if andes has none, otherwise saves the deadline to the job
+func (an *Andes) bindJob() {
+	e := an.eng()
+	job, _ := e.GetJobByRequestId(an.headwaters.RequestId)
+	if job == nil {
+		return
+	}
+	if job.ProcUnit == e.unit {
+		an.headwaters.setFence(job.Fence)
+	}
+	deadline, ok := an.headwaters.Deadline()
+	if !ok {
+		if !job.Deadline.IsZero() {
+			an.headwaters.SetDeadline(job.Deadline)
+		}
+		return
+	}
+	if !deadline.Equal(job.Deadline) {
+		_ = e.setJobDeadline(job.Id, deadline)
+	}
+}
+
+func (an *Andes) armDeadline() {
+	deadline, ok := an.headwaters.Deadline()
+	if !ok {
+		return
+	}
+	if !time.Now().UTC().Before(deadline) {
+		an.expire(deadline)
+		return
+	}
+	go func() {
+		t := time.NewTimer(time.Until(deadline))
+		defer t.Stop()
+		select {
+		case <-an.headwaters.Done():
+			return
+		case <-an.headwaters.atlantic.finished():
+			return
+		case <-an.eng().stopping:
+			return
+		case <-t.C:
+			an.expire(deadline)
+		}
+	}()
+}
+
+// watchCancel applies the cancel saved on a child andes by its parent river, before the andes
+// runs and while it's running
+func (an *Andes) watchCancel() {
+	if len(an.parentFlowId) == 0 || an.canceledByParent() {
+		return
+	}
+	go func() {
+		t := time.NewTicker(childPollInterval)
+		defer t.Stop()
+		for {
+			select {
+			case <-an.headwaters.Done():
+				return
+			case <-an.headwaters.atlantic.finished():
+				return
+			case <-an.eng().stopping:
+				return
+			case <-t.C:
+				if an.canceledByParent() || an.isFinished() {
+					return
+				}
+			}
+		}
+	}()
+}
+
+func (an *Andes) canceledByParent() bool {
+	root := an.eng().queryRootFlowByRequestId(an.headwaters.RequestId)
+	if root == nil || len(root.CancelErr) == 0 {
+		return false
+	}
+	logs.Warn("[%s]andes canceled by parent flow(%s), %s", an.headwaters.RequestId, an.parentFlowId, root.CancelErr)
+	err := childCancelErr(root.CancelErr)
+	an.headwaters.Cancel(err)
+	an.headwaters.basinCancel(err)
+	return true
+}
+
+func (an *Andes) expire(deadline time.Time) {
+	if an.isFinished() {
+		return
+	}
+	logs.Warn("[%s]andes deadline(%s) exceeded", an.headwaters.RequestId, deadline.String())
+	an.headwaters.Cancel(ErrorDeadline)
+	an.headwaters.basinCancel(ErrorDeadline)
+}
+
+func (an *Andes) isFinished() bool {
+	at := an.headwaters.atlantic
+	if len(at.getId()) == 0 {
+		return false
+	}
+	vf := an.eng().queryFlowById(at.getId())
+	if vf == nil {
+		return false
+	}
+	return vf.State == stateSuccess.String() || vf.State == stateFail.String()
+}
+
 func (an *Andes) outInner(rivers []Stream, startIndex int) {
 	for _, v := range rivers {
 		switch v.(type) {
-		case *ParallelRiver:
+		case ParallelStream:
 			vf := &VastFlow{
 				Id:       v.getId(),
 				Index:    startIndex,
@@ -99,12 +250,7 @@ func (an *Andes) outInner(rivers []Stream, startIndex int) {
 				WaterId:  v.getWaterId(),
 			}
 			logs.Debug("%v", vf)
-			vv, ok := v.(ParallelStream)
-			if !ok {
-				logs.Error("invalid parallel river")
-				return
-			}
-			for _, r := range vv.getRivers() {
+			for _, r := range v.(ParallelStream).getRivers() {
 				rivers := make([]Stream, 0)
 				rivers = append(rivers, r)
 				an.outInner(rivers, 0)
@@ -130,6 +276,37 @@ func (an *Andes) outInner(rivers []Stream, startIndex int) {
 			rivers = append(rivers, vv.getFirstDream())
 			an.outInner(rivers, 0)
 
+		case ChoiceStream:
+			vf := &VastFlow{
+				Id:       v.getId(),
+				Index:    startIndex,
+				FlowType: flowTypeChoice,
+				Name:     reflect.TypeOf(v).Elem().Name(),
+				Color:    v.GetColor(),
+				State:    v.getState().String(),
+				WaterId:  v.getWaterId(),
+			}
+			logs.Debug("%v", vf)
+			_, branches := v.(ChoiceStream).getBranches()
+			for _, r := range branches {
+				an.outInner([]Stream{r}, 0)
+			}
+
+		case MapStream:
+			vf := &VastFlow{
+				Id:       v.getId(),
+				Index:    startIndex,
+				FlowType: flowTypeMap,
+				Name:     reflect.TypeOf(v).Elem().Name(),
+				Color:    v.GetColor(),
+				State:    v.getState().String(),
+				WaterId:  v.getWaterId(),
+			}
+			logs.Debug("%v", vf)
+			for _, r := range v.(MapStream).getItems() {
+				an.outInner([]Stream{r}, 0)
+			}
+
 		default:
 			vf := &VastFlow{
 				Id:       v.getId(),
@@ -1,8 +1,9 @@
 package vastflow
 
 import (
+	"fmt"
 	"github.com/jack0liu/logs"
-	"reflect"
+	"sync"
 )
 
 type AtlanticFlow interface {
@@ -19,12 +20,40 @@ type AtlanticStream interface {
 	getState() streamState
 	setWaterId(waterId string)
 	getWaterId() string
+	finished() <-chan struct{}
 }
 
 type Atlantic struct {
 	id      string
 	state   streamState
 	waterId string // used to restore flow
+
+	mu   sync.Mutex
+	done chan struct{} // closed once the atlantic has run, not persist
+}
+
+// finished is closed once the atlantic has run in this unit, successfully or not
+func (at *Atlantic) finished() <-chan struct{} {
+	at.mu.Lock()
+	defer at.mu.Unlock()
+	if at.done == nil {
+		at.done = make(chan struct{})
+	}
+	return at.done
+}
+
+func (at *Atlantic) finish() {
+	at.mu.Lock()
+	defer at.mu.Unlock()
+	if at.done == nil {
+		at.done = closedChan
+		return
+	}
+	select {
+	case <-at.done:
+	default:
+		close(at.done)
+	}
 }
 
 func (at *Atlantic) updateWater(headwaters *Headwaters) error {
@@ -37,28 +66,29 @@ func (at *Atlantic) updateWater(headwaters *Headwaters) error {
 
 func (at *Atlantic) runSuccess(headwaters *Headwaters, flow AtlanticFlow) {
 	//logs.Debug("%v run , id :%s", reflect.ValueOf(flow).Elem().Type(), at.id)
+	defer at.finish()
 	defer func() {
 		if e := recover(); e != nil {
 			logs.Error("%v", e)
 			PrintStack()
-			_ = setFlowEnd(at.id, stateFail.String(), "got an panic")
+			_ = setFlowEnd(headwaters, at.id, stateFail.String(), "got an panic")
 		}
 	}()
-	at.releaseWnd()
+	at.releaseWnd(headwaters)
 	switch at.state {
 	case stateInit:
-		if err := setFlowStart(at.id, stateRunning.String()); err != nil {
+		if err := setFlowStart(headwaters, at.id, stateRunning.String()); err != nil {
 			logs.Error("update state fail, err:%s", err.Error())
 			return
 		}
 		fallthrough
 	case stateRunning:
-		job, _ := GetJobByRequestId(headwaters.RequestId)
-		if job != nil {
-			_ = UpdateJobStatus(job.Id, JobSuccess)
+		if err := finishJob(headwaters, JobSuccess); err == ErrorStaleFence {
+			logs.Warn("[%s]job is owned by others, atlantic skipped", headwaters.RequestId)
+			return
 		}
 		if err := flow.Success(headwaters); err != nil {
-			if err := setFlowEnd(at.id, stateFail.String(), err.Error()); err != nil {
+			if err := setFlowEnd(headwaters, at.id, stateFail.String(), err.Error()); err != nil {
 				logs.Error("update state fail, err:%s", err.Error())
 				return
 			}
@@ -66,7 +96,7 @@ func (at *Atlantic) runSuccess(headwaters *Headwaters, flow AtlanticFlow) {
 		if err := at.updateWater(headwaters); err != nil {
 			logs.Warn("update water fail, err:%s", err.Error())
 		}
-		if err := setFlowEnd(at.id, stateSuccess.String(), ""); err != nil {
+		if err := setFlowEnd(headwaters, at.id, stateSuccess.String(), ""); err != nil {
 			logs.Error("update state fail, err:%s", err.Error())
 			return
 		}
@@ -79,37 +109,44 @@ func (at *Atlantic) runSuccess(headwaters *Headwaters, flow AtlanticFlow) {
 }
 
 func (at *Atlantic) runFail(headwaters *Headwaters, flow AtlanticFlow) {
-	logs.Debug("%v run , id :%s, state:%s", reflect.ValueOf(flow).Elem().Type(), at.id, at.state.String())
+	logs.Debug("%v run , id :%s, state:%s", flowType(flow), at.id, at.state.String())
+	defer at.finish()
 	defer func() {
 		if e := recover(); e != nil {
 			logs.Error("%v", e)
 			PrintStack()
-			_ = setFlowEnd(at.id, stateFail.String(), "got an panic")
+			_ = setFlowEnd(headwaters, at.id, stateFail.String(), "got an panic")
 		}
 	}()
-	at.releaseWnd()
+	at.releaseWnd(headwaters)
 	switch at.state {
 	case stateInit:
-		if err := setFlowStart(at.id, stateRunning.String()); err != nil {
+		if err := setFlowStart(headwaters, at.id, stateRunning.String()); err != nil {
 			logs.Error("update state fail, err:%s", err.Error())
 			return
 		}
 		fallthrough
 	case stateRunning:
-		job, _ := GetJobByRequestId(headwaters.RequestId)
-		if job != nil {
-			_ = UpdateJobStatus(job.Id, JobFailed)
+		if err := finishJob(headwaters, JobFailed); err == ErrorStaleFence {
+			logs.Warn("[%s]job is owned by others, atlantic skipped", headwaters.RequestId)
+			return
 		}
 
+		var cause string
+		if headwaters.Err() != nil {
+			cause = headwaters.Err().Error()
+		}
 		if err := flow.Fail(headwaters); err != nil {
-			if err := setFlowEnd(at.id, stateFail.String(), err.Error()); err != nil {
-				logs.Error("update state fail, err:%s", err.Error())
+			if len(cause) > 0 {
+				cause = fmt.Sprintf("%s, atlantic fail:%s", cause, err.Error())
+			} else {
+				cause = err.Error()
 			}
 		}
 		if err := at.updateWater(headwaters); err != nil {
 			logs.Warn("update water fail, err:%s", err.Error())
 		}
-		if err := setFlowEnd(at.id, stateFail.String(), ""); err != nil {
+		if err := setFlowEnd(headwaters, at.id, stateFail.String(), cause); err != nil {
 			logs.Error("update state fail, err:%s", err.Error())
 			return
 		}
@@ -145,8 +182,9 @@ func (at *Atlantic) getWaterId() string {
 	return at.waterId
 }
 
-func (at *Atlantic) releaseWnd() {
-	flowWnd.Lock()
-	flowWnd.Dec()
-	flowWnd.Unlock()
+func (at *Atlantic) releaseWnd(headwaters *Headwaters) {
+	wnd := headwaters.eng().wnd
+	wnd.Lock()
+	wnd.release(headwaters.RequestId)
+	wnd.Unlock()
 }
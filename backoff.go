@@ -0,0 +1,76 @@
+package vastflow
+
+import (
+	"math"
+	"math/rand"
+	"sync"
+	"time"
+)
+
+type BackoffPolicy int32
+
+const (
+	// BackoffConstant waits the interval every time
+	BackoffConstant BackoffPolicy = 0
+	// BackoffLinear waits the interval multiplied by attempts
+	BackoffLinear BackoffPolicy = 1
+	// BackoffExponential doubles the interval every attempt
+	BackoffExponential BackoffPolicy = 2
+)
+
+var (
+	jitterMu   sync.Mutex
+	jitterRand = rand.New(rand.NewSource(time.Now().UnixNano()))
+)
+
+func (attr *RiverAttr) retryInterval() time.Duration {
+	if attr.RetryDelay > 0 {
+		return attr.RetryDelay
+	}
+	return time.Duration(attr.RetryInterval) * time.Second
+}
+
+func (attr *RiverAttr) cycleInterval() time.Duration {
+	if attr.CycleDelay > 0 {
+		return attr.CycleDelay
+	}
+	return time.Duration(attr.CycleInterval) * time.Second
+}
+
+func (attr *RiverAttr) maxInterval() time.Duration {
+	if attr.MaxDelay > 0 {
+		return attr.MaxDelay
+	}
+	return time.Duration(attr.MaxInterval) * time.Second
+}
+
+// backoff is the wait before attempt n (from 0) with interval base
+func (attr *RiverAttr) backoff(base time.Duration, n int32) time.Duration {
+	d := base
+	switch attr.Backoff {
+	case BackoffLinear:
+		d = base * time.Duration(n+1)
+	case BackoffExponential:
+		factor := math.Pow(2, float64(n))
+		if float64(base)*factor > math.MaxInt64 {
+			d = time.Duration(math.MaxInt64)
+		} else {
+			d = time.Duration(float64(base) * factor)
+		}
+	}
+	if max := attr.maxInterval(); max > 0 && d > max {
+		d = max
+	}
+	if attr.Jitter > 0 && d > 0 {
+		jitter := attr.Jitter
+		if jitter > 1 {
+			jitter = 1
+		}
+		jitterMu.Lock()
+		r := jitterRand.Float64()
+		jitterMu.Unlock()
+		// random in [d*(1-jitter), d]
+		d = d - time.Duration(float64(d)*jitter*r)
+	}
+	return d
+}
@@ -0,0 +1,61 @@
+package vastflow
+
+import (
+	"testing"
+	"time"
+)
+
+func TestBackoff(t *testing.T) {
+	tests := []struct {
+		name string
+		attr RiverAttr
+		n    int32
+		want time.Duration
+	}{
+		{"constant", RiverAttr{Backoff: BackoffConstant}, 3, time.Second},
+		{"linear", RiverAttr{Backoff: BackoffLinear}, 2, 3 * time.Second},
+		{"exponential first", RiverAttr{Backoff: BackoffExponential}, 0, time.Second},
+		{"exponential", RiverAttr{Backoff: BackoffExponential}, 3, 8 * time.Second},
+		{"capped by max delay", RiverAttr{Backoff: BackoffExponential, MaxDelay: 5 * time.Second}, 3, 5 * time.Second},
+		{"capped by max interval", RiverAttr{Backoff: BackoffLinear, MaxInterval: 2}, 4, 2 * time.Second},
+		{"overflow capped", RiverAttr{Backoff: BackoffExponential, MaxDelay: time.Minute}, 100, time.Minute},
+		{"overflow uncapped", RiverAttr{Backoff: BackoffExponential}, 100, time.Duration(1<<63 - 1)},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.attr.backoff(time.Second, tt.n); got != tt.want {
+				t.Fatalf("backoff = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestBackoffJitter(t *testing.T) {
+	tests := []struct {
+		jitter float64
+		min    time.Duration
+	}{
+		{0.5, 2 * time.Second},
+		{2, 0}, // jitter over 1 is taken as 1
+	}
+	for _, tt := range tests {
+		attr := RiverAttr{Backoff: BackoffExponential, Jitter: tt.jitter}
+		for i := 0; i < 100; i++ {
+			got := attr.backoff(time.Second, 2)
+			if got < tt.min || got > 4*time.Second {
+				t.Fatalf("jitter %v: backoff = %v, want in [%v, 4s]", tt.jitter, got, tt.min)
+			}
+		}
+	}
+}
+
+func TestRiverAttrIntervals(t *testing.T) {
+	attr := RiverAttr{RetryInterval: 2, CycleInterval: 3, MaxInterval: 4}
+	if attr.retryInterval() != 2*time.Second || attr.cycleInterval() != 3*time.Second || attr.maxInterval() != 4*time.Second {
+		t.Fatalf("second intervals not used, %v %v %v", attr.retryInterval(), attr.cycleInterval(), attr.maxInterval())
+	}
+	attr.RetryDelay, attr.CycleDelay, attr.MaxDelay = time.Millisecond, 2*time.Millisecond, 3*time.Millisecond
+	if attr.retryInterval() != time.Millisecond || attr.cycleInterval() != 2*time.Millisecond || attr.maxInterval() != 3*time.Millisecond {
+		t.Fatalf("delays don't override intervals, %v %v %v", attr.retryInterval(), attr.cycleInterval(), attr.maxInterval())
+	}
+}
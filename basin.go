@@ -33,29 +33,29 @@ func init() {
 func (rb *RiverBasin) setFail(errStr string, headwaters *Headwaters) error {
 	rb.state = stateFail
 	rb.errStr = errStr
-	if err := setFlowEnd(rb.id, stateFail.String(), errStr); err != nil {
+	if err := setFlowEnd(headwaters, rb.id, stateFail.String(), errStr); err != nil {
 		logs.Error("update state fail, err:%s", err.Error())
 		return err
 	}
 	if !rb.attr.isInner {
 		headwaters.Cancel(errors.New(errStr))
-		headwaters.atlantic.runFail(headwaters, headwaters.atlantic.(AtlanticFlow))
+		runFailure(headwaters)
 	}
 	return nil
 }
 
-func (rb *RiverBasin) setSuccess() error {
+func (rb *RiverBasin) setSuccess(headwaters *Headwaters) error {
 	rb.state = stateSuccess
-	if err := setFlowEnd(rb.id, stateSuccess.String(), ""); err != nil {
+	if err := setFlowEnd(headwaters, rb.id, stateSuccess.String(), ""); err != nil {
 		logs.Error("update state fail, err:%s", err.Error())
 		return err
 	}
 	return nil
 }
 
-func (rb *RiverBasin) setRunning() error {
+func (rb *RiverBasin) setRunning(headwaters *Headwaters) error {
 	rb.state = stateRunning
-	if err := setFlowStart(rb.id, stateRunning.String()); err != nil {
+	if err := setFlowStart(headwaters, rb.id, stateRunning.String()); err != nil {
 		logs.Error("update state fail, err:%s", err.Error())
 		return err
 	}
@@ -71,6 +71,8 @@ func (rb *RiverBasin) updateWater(headwaters *Headwaters) error {
 }
 
 func (rb *RiverBasin) Run(headwaters *Headwaters, flow RiverFlow, syncNext bool) (err error) {
+	headwaters.eng().enterRun()
+	defer headwaters.eng().leaveRun()
 	defer func() {
 		if e := recover(); e != nil {
 			logs.Error("%v", e)
@@ -82,12 +84,15 @@ func (rb *RiverBasin) Run(headwaters *Headwaters, flow RiverFlow, syncNext bool)
 	rb.runInit(flow)
 	switch rb.state {
 	case stateInit:
-		if err = rb.setRunning(); err != nil {
+		if err = rb.setRunning(headwaters); err != nil {
 			return err
 		}
 		fallthrough
 	case stateRunning:
 		if err = rb.runFlow(headwaters, flow); err != nil {
+			if err == ErrorShutdown {
+				return err
+			}
 			if err := rb.setFail("", headwaters); err != nil {
 				return err
 			}
@@ -98,7 +103,7 @@ func (rb *RiverBasin) Run(headwaters *Headwaters, flow RiverFlow, syncNext bool)
 				return err
 			}
 		}
-		if err = rb.setSuccess(); err != nil {
+		if err = rb.setSuccess(headwaters); err != nil {
 			return err
 		}
 		fallthrough
@@ -108,6 +113,10 @@ func (rb *RiverBasin) Run(headwaters *Headwaters, flow RiverFlow, syncNext bool)
 		logs.Error("flow has been failed")
 		err = errors.New("flow has been failed")
 		headwaters.Cancel(err)
+		if !rb.attr.isInner {
+			// resume failure interrupted before atlantic
+			runFailure(headwaters)
+		}
 		return err
 
 	default:
@@ -180,12 +189,17 @@ func (rb *RiverBasin) getWaterId() string {
 	return rb.waterId
 }
 
-func (rb *RiverBasin) runRiver(headwaters *Headwaters, river Stream) {
-	if err := river.Run(headwaters, river.(RiverFlow), true); err != nil && err != ErrorBasinCanceled {
+func (rb *RiverBasin) runRiver(headwaters *Headwaters, river Stream) error {
+	err := river.Run(headwaters, riverFlowOf(river), true)
+	if err == ErrorShutdown {
+		return err
+	}
+	if err != nil && err != ErrorBasinCanceled {
 		logs.Error(err.Error())
 		headwaters.basinCancel(err)
 	}
 	logs.Debug("basin finish")
+	return nil
 }
 
 func (rb *RiverBasin) Update(attr *RiverAttr) {
@@ -203,7 +217,7 @@ func (rb *RiverBasin) Cycle(headwaters *Headwaters) (errCause string, err error)
 }
 
 func (rb *RiverBasin) DrawStream(river Stream) *RiverBasin {
-	if _, ok := river.(RiverFlow); !ok {
+	if riverFlowOf(river) == nil {
 		panic("river not implement RiverFlow")
 	}
 
@@ -233,14 +247,18 @@ func (rb *RiverBasin) runInit(flow RiverFlow) {
 func (rb *RiverBasin) runNext(headwaters *Headwaters, syncNext bool) error {
 	// do next
 	if rb.next() != nil {
+		if headwaters.eng().isShuttingDown() {
+			logs.Info("[%s][%s]unit is shutting down, stop before next", headwaters.RequestId, rb.color)
+			return ErrorShutdown
+		}
 		if syncNext {
-			return rb.next().Run(headwaters, rb.next().(RiverFlow), syncNext)
+			return rb.next().Run(headwaters, riverFlowOf(rb.next()), syncNext)
 		} else {
-			go rb.next().Run(headwaters, rb.next().(RiverFlow), syncNext)
+			headwaters.eng().goRun(rb.next(), headwaters, syncNext)
 		}
 	} else {
 		if !rb.attr.isInner {
-			headwaters.atlantic.runSuccess(headwaters, headwaters.atlantic.(AtlanticFlow))
+			headwaters.atlantic.runSuccess(headwaters, atlanticFlowOf(headwaters.atlantic))
 		}
 	}
 	return nil
@@ -262,16 +280,17 @@ func (rb *RiverBasin) runFlow(headwaters *Headwaters, flow RiverFlow) error {
 	}
 	logs.Debug("headwaters id:%s", rb.first.getWaterId())
 	var newHeadwaters *Headwaters
-	fw := queryWaterById(rb.first.getWaterId())
+	fw := headwaters.eng().queryWaterById(rb.first.getWaterId())
 	if fw == nil {
 		logs.Error("no flow water")
 		return errors.New("no flow water")
 	}
 	if rb.isWaterUpdated(fw) {
-		newHeadwaters = fromPersistWater(fw.Headwaters)
+		newHeadwaters = headwaters.eng().fromPersistWater(fw.Headwaters)
 
 		// replace global and basin context
 		newHeadwaters.atlantic = headwaters.atlantic
+		newHeadwaters.setJob(headwaters.jobRequestId(), headwaters.getFence())
 		newHeadwaters.basinDone = headwaters.basinDone
 		newHeadwaters.basinMu = headwaters.basinMu
 		newHeadwaters.basinErr = headwaters.basinErr
@@ -280,7 +299,9 @@ func (rb *RiverBasin) runFlow(headwaters *Headwaters, flow RiverFlow) error {
 		newHeadwaters.id = rb.first.getWaterId()
 	}
 	logs.Debug("new basin(%s) headwaters id:%s", rb.color, newHeadwaters.id)
-	rb.runRiver(newHeadwaters, rb.first)
+	if err := rb.runRiver(newHeadwaters, rb.first); err != nil {
+		return err
+	}
 	headwaters.Replace(newHeadwaters)
 	return headwaters.basinError()
 }
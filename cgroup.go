@@ -0,0 +1,148 @@
+package vastflow
+
+import (
+	"bufio"
+	"github.com/jack0liu/logs"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+)
+
+const (
+	cgroupRoot = "/sys/fs/cgroup"
+	// v1 reports a huge number as memory limit if it's unlimited
+	cgroupNoMemLimit = uint64(1) << 62
+)
+
+// cgroupLimit is the cpu quota and memory limit of the process's cgroup, zero means no limit
+type cgroupLimit struct {
+	v2       bool
+	cpuCores float64
+	memBytes uint64
+	memDir   string // where to read memory usage
+}
+
+// detectCgroup reads cgroup v2 or v1 limits of this process
+func detectCgroup() *cgroupLimit {
+	paths := readProcCgroup()
+	if dir, ok := cgroupDir(paths[""], "cpu.max"); ok {
+		cg := &cgroupLimit{v2: true}
+		cg.cpuCores = readCpuMax(path.Join(dir, "cpu.max"))
+		if memDir, ok := cgroupDir(paths[""], "memory.max"); ok {
+			cg.memBytes = readUint(path.Join(memDir, "memory.max"))
+			cg.memDir = memDir
+		}
+		logs.Info("cgroup v2, cpu cores:%f, memory limit:%d", cg.cpuCores, cg.memBytes)
+		return cg
+	}
+
+	cg := &cgroupLimit{}
+	cpuBase := path.Join(cgroupRoot, "cpu")
+	if dir, ok := cgroupDir(paths["cpu"], path.Join("cpu", "cpu.cfs_quota_us")); ok {
+		cpuBase = dir
+	} else if dir, ok := cgroupDir(paths["cpu"], path.Join("cpu,cpuacct", "cpu.cfs_quota_us")); ok {
+		cpuBase = dir
+	}
+	quota, err := strconv.ParseInt(readLine(path.Join(cpuBase, "cpu.cfs_quota_us")), 10, 64)
+	if err == nil && quota > 0 {
+		period := readUint(path.Join(cpuBase, "cpu.cfs_period_us"))
+		if period > 0 {
+			cg.cpuCores = float64(quota) / float64(period)
+		}
+	}
+	if dir, ok := cgroupDir(paths["memory"], path.Join("memory", "memory.limit_in_bytes")); ok {
+		limit := readUint(path.Join(dir, "memory.limit_in_bytes"))
+		if limit < cgroupNoMemLimit {
+			cg.memBytes = limit
+		}
+		cg.memDir = dir
+	}
+	logs.Info("cgroup v1, cpu cores:%f, memory limit:%d", cg.cpuCores, cg.memBytes)
+	return cg
+}
+
+// memUsage reads memory used by the cgroup
+func (cg *cgroupLimit) memUsage() uint64 {
+	if len(cg.memDir) == 0 {
+		return 0
+	}
+	if cg.v2 {
+		return readUint(path.Join(cg.memDir, "memory.current"))
+	}
+	return readUint(path.Join(cg.memDir, "memory.usage_in_bytes"))
+}
+
+// readProcCgroup maps controllers to cgroup paths of this process, v2 uses the empty controller
+func readProcCgroup() map[string]string {
+	f, err := os.Open("/proc/self/cgroup")
+	if err != nil {
+		return make(map[string]string)
+	}
+	defer f.Close()
+	return parseProcCgroup(f)
+}
+
+// parseProcCgroup parses lines like "hierarchy-ID:controller-list:cgroup-path"
+func parseProcCgroup(r io.Reader) map[string]string {
+	paths := make(map[string]string)
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		parts := strings.SplitN(scanner.Text(), ":", 3)
+		if len(parts) != 3 {
+			continue
+		}
+		if len(parts[1]) == 0 {
+			paths[""] = parts[2]
+			continue
+		}
+		for _, c := range strings.Split(parts[1], ",") {
+			paths[c] = parts[2]
+		}
+	}
+	return paths
+}
+
+// cgroupDir finds the dir of file under the process's cgroup path, or the root in a cgroup namespace
+func cgroupDir(cgPath, file string) (string, bool) {
+	candidates := []string{path.Join(cgroupRoot, path.Dir(file), cgPath), path.Join(cgroupRoot, path.Dir(file))}
+	for _, dir := range candidates {
+		if _, err := os.Stat(path.Join(dir, path.Base(file))); err == nil {
+			return dir, true
+		}
+	}
+	return "", false
+}
+
+func readCpuMax(file string) float64 {
+	// "$MAX $PERIOD", max is "max" if unlimited
+	fields := strings.Fields(readLine(file))
+	if len(fields) != 2 || fields[0] == "max" {
+		return 0
+	}
+	quota := parseFloat(fields[0])
+	period := parseFloat(fields[1])
+	if quota <= 0 || period <= 0 {
+		return 0
+	}
+	return quota / period
+}
+
+func readUint(file string) uint64 {
+	v, err := strconv.ParseUint(readLine(file), 10, 64)
+	if err != nil {
+		// "max" or missed
+		return 0
+	}
+	return v
+}
+
+func readLine(file string) string {
+	b, err := ioutil.ReadFile(file)
+	if err != nil {
+		return ""
+	}
+	return strings.TrimSpace(string(b))
+}
@@ -0,0 +1,88 @@
+package vastflow
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestParseProcCgroup(t *testing.T) {
+	tests := []struct {
+		name    string
+		content string
+		want    map[string]string
+	}{
+		{"v2", "0::/kubepods/pod1/abc\n", map[string]string{"": "/kubepods/pod1/abc"}},
+		{"v1", "12:memory:/docker/abc\n4:cpu,cpuacct:/docker/abc\nbad line\n1:name=systemd:/init.scope\n",
+			map[string]string{"memory": "/docker/abc", "cpu": "/docker/abc", "cpuacct": "/docker/abc", "name=systemd": "/init.scope"}},
+		{"hybrid", "5:memory:/user.slice\n0::/user.slice/session-1.scope\n",
+			map[string]string{"memory": "/user.slice", "": "/user.slice/session-1.scope"}},
+		{"empty", "", map[string]string{}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := parseProcCgroup(strings.NewReader(tt.content)); !reflect.DeepEqual(got, tt.want) {
+				t.Fatalf("parseProcCgroup = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func writeCgroupFile(t *testing.T, dir, name, content string) string {
+	file := path.Join(dir, name)
+	if err := ioutil.WriteFile(file, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return file
+}
+
+func TestReadCpuMax(t *testing.T) {
+	dir, err := ioutil.TempDir("", "cgroup")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	tests := []struct {
+		content string
+		want    float64
+	}{
+		{"200000 100000\n", 2},
+		{"50000 100000", 0.5},
+		{"max 100000\n", 0},
+		{"0 100000", 0},
+		{"100000", 0},
+		{"", 0},
+	}
+	for _, tt := range tests {
+		if got := readCpuMax(writeCgroupFile(t, dir, "cpu.max", tt.content)); got != tt.want {
+			t.Fatalf("readCpuMax(%q) = %v, want %v", tt.content, got, tt.want)
+		}
+	}
+	if got := readCpuMax(path.Join(dir, "missed")); got != 0 {
+		t.Fatalf("readCpuMax of missed file = %v", got)
+	}
+}
+
+func TestReadUint(t *testing.T) {
+	dir, err := ioutil.TempDir("", "cgroup")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	tests := []struct {
+		content string
+		want    uint64
+	}{
+		{"536870912\n", 536870912},
+		{"max\n", 0},
+		{"", 0},
+	}
+	for _, tt := range tests {
+		if got := readUint(writeCgroupFile(t, dir, "memory.max", tt.content)); got != tt.want {
+			t.Fatalf("readUint(%q) = %v, want %v", tt.content, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,398 @@
+package vastflow
+
+import (
+	"errors"
+	"fmt"
+	"github.com/jack0liu/logs"
+	"github.com/satori/go.uuid"
+	"time"
+)
+
+const childPollInterval = 2 * time.Second
+
+// Child draws the andes run by a child river. The andes and its headwaters are created
+// already, Draw copies what the child needs from the parent headwaters, then draws rivers
+// and atlantic. Merge maps outputs of the succeeded child back to the parent headwaters.
+type Child interface {
+	Draw(parent *Headwaters, andes *Andes)
+	Merge(child, parent *Headwaters) error
+}
+
+type ChildStream interface {
+	setChild(requestId string)
+}
+
+// ChildRiver runs a whole andes as one river. It's embedded by a type implementing Child,
+// the child andes is saved with a link to the river, the river waits until its atlantic is
+// done, resuming the child if both were restarted. The child runs under the job of the river,
+// its writes are rejected once the job is claimed by another unit. Canceling the river saves
+// the cancel on the child, which is applied even if the child is resumed later.
+type ChildRiver struct {
+	attr RiverAttr
+
+	childId string // request id of the child andes
+	child   *Andes // child andes running in this unit
+
+	id      string
+	errStr  string // failed error str
+	down    Stream
+	state   streamState
+	color   string
+	waterId string // used for restore
+}
+
+func (cr *ChildRiver) setFail(errStr string, headwaters *Headwaters) error {
+	cr.state = stateFail
+	cr.errStr = errStr
+	if err := setFlowEnd(headwaters, cr.id, stateFail.String(), errStr); err != nil {
+		logs.Error("update state fail, err:%s", err.Error())
+		return err
+	}
+	if !cr.attr.isInner {
+		headwaters.Cancel(errors.New(errStr))
+		runFailure(headwaters)
+	}
+	return nil
+}
+
+func (cr *ChildRiver) setSuccess(headwaters *Headwaters) error {
+	cr.state = stateSuccess
+	if err := setFlowEnd(headwaters, cr.id, stateSuccess.String(), ""); err != nil {
+		logs.Error("update state fail, err:%s", err.Error())
+		return err
+	}
+	return nil
+}
+
+func (cr *ChildRiver) setRunning(headwaters *Headwaters) error {
+	cr.state = stateRunning
+	if err := setFlowStart(headwaters, cr.id, stateRunning.String()); err != nil {
+		logs.Error("update state fail, err:%s", err.Error())
+		return err
+	}
+	return nil
+}
+
+func (cr *ChildRiver) updateWater(headwaters *Headwaters) error {
+	if err := updateHeadwaters(headwaters); err != nil {
+		logs.Error("update water fail, err:%s", err.Error())
+		return err
+	}
+	return nil
+}
+
+func (cr *ChildRiver) Run(headwaters *Headwaters, flow RiverFlow, syncNext bool) (err error) {
+	headwaters.eng().enterRun()
+	defer headwaters.eng().leaveRun()
+	defer func() {
+		if e := recover(); e != nil {
+			logs.Error("%v", e)
+			PrintStack()
+			_ = cr.setFail("got an panic", headwaters)
+			err = errors.New("got an panic")
+		}
+	}()
+	cr.runInit(flow)
+	switch cr.state {
+	case stateInit:
+		if err = cr.setRunning(headwaters); err != nil {
+			return err
+		}
+		fallthrough
+	case stateRunning:
+		if err = cr.runFlow(headwaters, flow); err != nil {
+			if err == ErrorShutdown {
+				return err
+			}
+			if err2 := cr.setFail(err.Error(), headwaters); err2 != nil {
+				logs.Error("child set fail failed")
+			}
+			return err
+		}
+		if err = cr.updateWater(headwaters); err != nil {
+			return err
+		}
+		if err = cr.setSuccess(headwaters); err != nil {
+			return err
+		}
+		fallthrough
+	case stateSuccess:
+		return cr.runNext(headwaters, syncNext)
+	case stateFail:
+		logs.Error("flow has been failed")
+		cr.stopChild(headwaters)
+		err = errors.New("flow has been failed")
+		headwaters.Cancel(err)
+		if !cr.attr.isInner {
+			// resume failure interrupted before atlantic
+			runFailure(headwaters)
+		}
+		return err
+
+	default:
+		logs.Error("invalid child river state:%s", cr.state.String())
+		return errors.New("invalid child river state:" + cr.state.String())
+	}
+}
+
+func (cr *ChildRiver) runFlow(headwaters *Headwaters, flow RiverFlow) error {
+	select {
+	case <-headwaters.basinFinish():
+		return ErrorCanceled
+	case <-headwaters.Done():
+		return ErrorCanceled
+	default:
+	}
+	child, ok := flow.(Child)
+	if !ok {
+		return errors.New("child river not implement Child")
+	}
+	if len(cr.childId) == 0 {
+		// linked before the child is saved, so it's found again after restart
+		childId := uuid.NewV4().String()
+		if err := setFlowChild(headwaters, cr.id, childId); err != nil {
+			logs.Error("update child fail, err:%s", err.Error())
+			return err
+		}
+		cr.childId = childId
+	}
+	if err := cr.startChild(headwaters, child); err != nil {
+		return err
+	}
+	return cr.waitChild(headwaters, child)
+}
+
+// startChild starts the child andes, or resumes the one saved before restart
+func (cr *ChildRiver) startChild(headwaters *Headwaters, child Child) error {
+	if cr.child != nil {
+		return nil
+	}
+	e := headwaters.eng()
+	andes, err := e.loadAndesByRequestId(cr.childId)
+	if err == errNoFlow {
+		andes = e.NewAndes()
+		andes.DrawHeadWaters(NewHeadwaters(cr.childId))
+		child.Draw(headwaters, andes)
+		cr.bindChild(headwaters, andes)
+		if deadline, ok := headwaters.Deadline(); ok {
+			if _, ok := andes.headwaters.Deadline(); !ok {
+				andes.DrawDeadline(deadline)
+			}
+		}
+		andes.parentFlowId = cr.id
+		if _, err := andes.Start(); err != nil {
+			logs.Error("[%s]start child andes(%s) fail, err:%s", headwaters.RequestId, cr.childId, err.Error())
+			return err
+		}
+		logs.Info("[%s][%s]child andes(%s) started", headwaters.RequestId, cr.color, cr.childId)
+		cr.child = andes
+		return nil
+	}
+	if err != nil {
+		logs.Error("[%s]load child andes(%s) fail, err:%s", headwaters.RequestId, cr.childId, err.Error())
+		return err
+	}
+	if !andes.isFinished() {
+		cr.bindChild(headwaters, andes)
+		if err := andes.ReStart(); err != nil {
+			logs.Error("[%s]restart child andes(%s) fail, err:%s", headwaters.RequestId, cr.childId, err.Error())
+			return err
+		}
+		logs.Info("[%s][%s]child andes(%s) resumed", headwaters.RequestId, cr.color, cr.childId)
+	}
+	cr.child = andes
+	return nil
+}
+
+// waitChild polls the atlantic of the child, and merges the child headwaters once it succeeds
+func (cr *ChildRiver) waitChild(headwaters *Headwaters, child Child) error {
+	e := headwaters.eng()
+	ticker := time.NewTicker(childPollInterval)
+	defer ticker.Stop()
+	for {
+		if flows := e.queryAtlanticByRequestId(cr.childId); len(flows) > 0 {
+			switch flows[0].State {
+			case stateSuccess.String():
+				return cr.merge(headwaters, child)
+			case stateFail.String():
+				return fmt.Errorf("child andes(%s) failed, %s", cr.childId, flows[0].Error)
+			}
+		}
+		select {
+		case <-headwaters.Done():
+			cr.cancelChild(headwaters, headwaters.Err())
+			return ErrorCanceled
+		case <-headwaters.basinFinish():
+			cr.cancelChild(headwaters, ErrorCanceled)
+			return ErrorCanceled
+		case <-e.stopping:
+			return ErrorShutdown
+		case <-ticker.C:
+		}
+	}
+}
+
+func (cr *ChildRiver) merge(headwaters *Headwaters, child Child) error {
+	e := headwaters.eng()
+	root := e.queryRootFlowByRequestId(cr.childId)
+	if root == nil {
+		return fmt.Errorf("missed child andes(%s)", cr.childId)
+	}
+	fw := e.queryWaterById(root.WaterId)
+	if fw == nil {
+		return fmt.Errorf("missed water of child andes(%s)", cr.childId)
+	}
+	hw := e.fromPersistWater(fw.Headwaters)
+	if hw == nil {
+		return fmt.Errorf("invalid water of child andes(%s)", cr.childId)
+	}
+	logs.Info("[%s][%s]child andes(%s) succeeded", headwaters.RequestId, cr.color, cr.childId)
+	return child.Merge(hw, headwaters)
+}
+
+// bindChild fences writes of the child by the job of the river
+func (cr *ChildRiver) bindChild(headwaters *Headwaters, andes *Andes) {
+	andes.headwaters.setJob(headwaters.jobRequestId(), headwaters.getFence())
+}
+
+// cancelChild saves the cancel on the child before canceling the one running here, the saved
+// one cancels the child wherever it's resumed
+func (cr *ChildRiver) cancelChild(headwaters *Headwaters, err error) {
+	if len(cr.childId) == 0 {
+		return
+	}
+	if err == nil {
+		err = ErrorCanceled
+	}
+	logs.Info("[%s][%s]cancel child andes(%s)", headwaters.RequestId, cr.color, cr.childId)
+	if sErr := setAndesCancel(headwaters, cr.childId, err.Error()); sErr != nil {
+		logs.Error("[%s]save cancel of child andes(%s) fail, err:%s", headwaters.RequestId, cr.childId, sErr.Error())
+	}
+	if cr.child == nil || cr.child.headwaters == nil {
+		return
+	}
+	cr.child.headwaters.Cancel(err)
+	cr.child.headwaters.basinCancel(err)
+}
+
+// stopChild resumes the child left unfinished by the failed river, canceled, so it runs to its atlantic
+func (cr *ChildRiver) stopChild(headwaters *Headwaters) {
+	if len(cr.childId) == 0 {
+		return
+	}
+	andes, err := headwaters.eng().loadAndesByRequestId(cr.childId)
+	if err != nil || andes.isFinished() {
+		return
+	}
+	if err := setAndesCancel(headwaters, cr.childId, ErrorCanceled.Error()); err != nil {
+		logs.Error("[%s]save cancel of child andes(%s) fail, err:%s", headwaters.RequestId, cr.childId, err.Error())
+		return
+	}
+	cr.bindChild(headwaters, andes)
+	if err := andes.ReStart(); err != nil {
+		logs.Error("[%s]stop child andes(%s) fail, err:%s", headwaters.RequestId, cr.childId, err.Error())
+	}
+}
+
+// childCancelErr restores the cancel error saved by the parent river
+func childCancelErr(errStr string) error {
+	for _, err := range []error{ErrorCanceled, ErrorBasinCanceled, ErrorDeadline} {
+		if err.Error() == errStr {
+			return err
+		}
+	}
+	return errors.New(errStr)
+}
+
+// ChildRequestId is the request id of the child andes, empty before it starts
+func (cr *ChildRiver) ChildRequestId() string {
+	return cr.childId
+}
+
+func (cr *ChildRiver) setChild(requestId string) {
+	cr.childId = requestId
+}
+
+func (cr *ChildRiver) runInit(flow RiverFlow) {
+	flow.Update(&cr.attr)
+}
+
+func (cr *ChildRiver) runNext(headwaters *Headwaters, syncNext bool) error {
+	// do next
+	if cr.next() != nil {
+		if headwaters.eng().isShuttingDown() {
+			logs.Info("[%s][%s]unit is shutting down, stop before next", headwaters.RequestId, cr.color)
+			return ErrorShutdown
+		}
+		if syncNext {
+			return cr.next().Run(headwaters, riverFlowOf(cr.next()), syncNext)
+		} else {
+			headwaters.eng().goRun(cr.next(), headwaters, syncNext)
+		}
+	} else {
+		if !cr.attr.isInner {
+			headwaters.atlantic.runSuccess(headwaters, atlanticFlowOf(headwaters.atlantic))
+		}
+	}
+	return nil
+}
+
+func (cr *ChildRiver) Update(attr *RiverAttr) {
+}
+
+func (cr *ChildRiver) Flow(headwaters *Headwaters) (errCause string, err error) {
+	return "", nil
+}
+
+func (cr *ChildRiver) Cycle(headwaters *Headwaters) (errCause string, err error) {
+	return "", nil
+}
+
+func (cr *ChildRiver) next() Stream {
+	return cr.down
+}
+
+func (cr *ChildRiver) SetDownStream(down Stream) {
+	cr.down = down
+}
+
+func (cr *ChildRiver) setInner() {
+	cr.attr.isInner = true
+}
+
+func (cr *ChildRiver) setId(id string) {
+	cr.id = id
+}
+
+func (cr *ChildRiver) getId() string {
+	return cr.id
+}
+
+func (cr *ChildRiver) setColor(color string) {
+	cr.color = color
+}
+
+// used for load
+func (cr *ChildRiver) colorCurrent(color string) {
+	cr.color = color
+}
+
+func (cr *ChildRiver) GetColor() string {
+	return cr.color
+}
+
+func (cr *ChildRiver) setState(state streamState) {
+	cr.state = state
+}
+
+func (cr *ChildRiver) getState() streamState {
+	return cr.state
+}
+
+func (cr *ChildRiver) setWaterId(waterId string) {
+	cr.waterId = waterId
+}
+
+func (cr *ChildRiver) getWaterId() string {
+	return cr.waterId
+}
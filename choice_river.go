@@ -0,0 +1,287 @@
+package vastflow
+
+import (
+	"errors"
+	"fmt"
+	"github.com/jack0liu/logs"
+)
+
+// Chooser picks the branch to run by name from headwaters
+type Chooser interface {
+	Choose(headwaters *Headwaters) string
+}
+
+type ChoiceStream interface {
+	DrawBranch(name string, river Stream) *ChoiceRiver
+	getBranches() ([]string, []Stream)
+	setChosen(name string)
+}
+
+// ChoiceRiver runs exactly one of its branches. It's embedded by a type implementing Chooser,
+// the chosen branch is saved, so a reloaded andes resumes the same branch.
+type ChoiceRiver struct {
+	attr RiverAttr
+
+	names    []string
+	branches []Stream
+	chosen   string
+
+	id      string
+	errStr  string // failed error str
+	down    Stream
+	state   streamState
+	color   string
+	waterId string // used for restore
+}
+
+func (cr *ChoiceRiver) setFail(errStr string, headwaters *Headwaters) error {
+	cr.state = stateFail
+	cr.errStr = errStr
+	if err := setFlowEnd(headwaters, cr.id, stateFail.String(), errStr); err != nil {
+		logs.Error("update state fail, err:%s", err.Error())
+		return err
+	}
+	if !cr.attr.isInner {
+		headwaters.Cancel(errors.New(errStr))
+		runFailure(headwaters)
+	}
+	return nil
+}
+
+func (cr *ChoiceRiver) setSuccess(headwaters *Headwaters) error {
+	cr.state = stateSuccess
+	if err := setFlowEnd(headwaters, cr.id, stateSuccess.String(), ""); err != nil {
+		logs.Error("update state fail, err:%s", err.Error())
+		return err
+	}
+	return nil
+}
+
+func (cr *ChoiceRiver) setRunning(headwaters *Headwaters) error {
+	cr.state = stateRunning
+	if err := setFlowStart(headwaters, cr.id, stateRunning.String()); err != nil {
+		logs.Error("update state fail, err:%s", err.Error())
+		return err
+	}
+	return nil
+}
+
+func (cr *ChoiceRiver) updateWater(headwaters *Headwaters) error {
+	if err := updateHeadwaters(headwaters); err != nil {
+		logs.Error("update water fail, err:%s", err.Error())
+		return err
+	}
+	return nil
+}
+
+func (cr *ChoiceRiver) Run(headwaters *Headwaters, flow RiverFlow, syncNext bool) (err error) {
+	headwaters.eng().enterRun()
+	defer headwaters.eng().leaveRun()
+	defer func() {
+		if e := recover(); e != nil {
+			logs.Error("%v", e)
+			PrintStack()
+			_ = cr.setFail("got an panic", headwaters)
+			err = errors.New("got an panic")
+		}
+	}()
+	cr.runInit(flow)
+	switch cr.state {
+	case stateInit:
+		if err = cr.setRunning(headwaters); err != nil {
+			return err
+		}
+		fallthrough
+	case stateRunning:
+		if err = cr.runFlow(headwaters, flow); err != nil {
+			if err == ErrorShutdown {
+				return err
+			}
+			if err2 := cr.setFail(err.Error(), headwaters); err2 != nil {
+				logs.Error("choice set fail failed")
+			}
+			return err
+		}
+		if cr.attr.Durable {
+			if err = cr.updateWater(headwaters); err != nil {
+				return err
+			}
+		}
+		if err = cr.setSuccess(headwaters); err != nil {
+			return err
+		}
+		fallthrough
+	case stateSuccess:
+		return cr.runNext(headwaters, syncNext)
+	case stateFail:
+		logs.Error("flow has been failed")
+		err = errors.New("flow has been failed")
+		headwaters.Cancel(err)
+		if !cr.attr.isInner {
+			// resume failure interrupted before atlantic
+			runFailure(headwaters)
+		}
+		return err
+
+	default:
+		logs.Error("invalid choice river state:%s", cr.state.String())
+		return errors.New("invalid choice river state:" + cr.state.String())
+	}
+}
+
+func (cr *ChoiceRiver) runFlow(headwaters *Headwaters, flow RiverFlow) error {
+	select {
+	case <-headwaters.basinFinish():
+		return ErrorCanceled
+	case <-headwaters.Done():
+		return ErrorCanceled
+	default:
+	}
+	if len(cr.chosen) == 0 {
+		chooser, ok := flow.(Chooser)
+		if !ok {
+			return errors.New("choice river not implement Chooser")
+		}
+		name := chooser.Choose(headwaters)
+		if cr.branch(name) == nil {
+			return fmt.Errorf("choice river has no branch:%q", name)
+		}
+		if err := setFlowBranch(headwaters, cr.id, name); err != nil {
+			logs.Error("update branch fail, err:%s", err.Error())
+			return err
+		}
+		cr.chosen = name
+		logs.Info("[%s][%s]choose branch:%s", headwaters.RequestId, cr.color, name)
+	}
+	branch := cr.branch(cr.chosen)
+	if branch == nil {
+		return fmt.Errorf("choice river has no branch:%q", cr.chosen)
+	}
+	return branch.Run(headwaters, riverFlowOf(branch), true)
+}
+
+func (cr *ChoiceRiver) branch(name string) Stream {
+	for i, n := range cr.names {
+		if n == name {
+			return cr.branches[i]
+		}
+	}
+	return nil
+}
+
+// DrawBranch adds a branch named name, Choose returns the name to run it
+func (cr *ChoiceRiver) DrawBranch(name string, river Stream) *ChoiceRiver {
+	if riverFlowOf(river) == nil {
+		panic("river not implement RiverFlow")
+	}
+	if cr.branch(name) != nil {
+		panic(fmt.Sprintf("choice branch is dumplicated, name:%q", name))
+	}
+	river.setColor(cr.color)
+	river.setInner()
+	for r := river.next(); r != nil; r = r.next() {
+		r.setColor(cr.color)
+		r.setInner()
+	}
+	cr.names = append(cr.names, name)
+	cr.branches = append(cr.branches, river)
+	return cr
+}
+
+func (cr *ChoiceRiver) getBranches() ([]string, []Stream) {
+	return cr.names, cr.branches
+}
+
+func (cr *ChoiceRiver) setChosen(name string) {
+	cr.chosen = name
+}
+
+func (cr *ChoiceRiver) runInit(flow RiverFlow) {
+	flow.Update(&cr.attr)
+}
+
+func (cr *ChoiceRiver) runNext(headwaters *Headwaters, syncNext bool) error {
+	// do next
+	if cr.next() != nil {
+		if headwaters.eng().isShuttingDown() {
+			logs.Info("[%s][%s]unit is shutting down, stop before next", headwaters.RequestId, cr.color)
+			return ErrorShutdown
+		}
+		if syncNext {
+			return cr.next().Run(headwaters, riverFlowOf(cr.next()), syncNext)
+		} else {
+			headwaters.eng().goRun(cr.next(), headwaters, syncNext)
+		}
+	} else {
+		if !cr.attr.isInner {
+			headwaters.atlantic.runSuccess(headwaters, atlanticFlowOf(headwaters.atlantic))
+		}
+	}
+	return nil
+}
+
+func (cr *ChoiceRiver) Update(attr *RiverAttr) {
+}
+
+func (cr *ChoiceRiver) Flow(headwaters *Headwaters) (errCause string, err error) {
+	return "", nil
+}
+
+func (cr *ChoiceRiver) Cycle(headwaters *Headwaters) (errCause string, err error) {
+	return "", nil
+}
+
+func (cr *ChoiceRiver) next() Stream {
+	return cr.down
+}
+
+func (cr *ChoiceRiver) SetDownStream(down Stream) {
+	cr.down = down
+}
+
+func (cr *ChoiceRiver) setInner() {
+	cr.attr.isInner = true
+}
+
+func (cr *ChoiceRiver) setId(id string) {
+	cr.id = id
+}
+
+func (cr *ChoiceRiver) getId() string {
+	return cr.id
+}
+
+func (cr *ChoiceRiver) setColor(color string) {
+	cr.color = color
+	for _, river := range cr.branches {
+		river.setColor(color)
+		for r := river.next(); r != nil; r = r.next() {
+			r.setColor(color)
+		}
+	}
+}
+
+// used for load
+func (cr *ChoiceRiver) colorCurrent(color string) {
+	cr.color = color
+}
+
+func (cr *ChoiceRiver) GetColor() string {
+	return cr.color
+}
+
+func (cr *ChoiceRiver) setState(state streamState) {
+	cr.state = state
+}
+
+func (cr *ChoiceRiver) getState() streamState {
+	return cr.state
+}
+
+func (cr *ChoiceRiver) setWaterId(waterId string) {
+	cr.waterId = waterId
+}
+
+func (cr *ChoiceRiver) getWaterId() string {
+	return cr.waterId
+}
@@ -0,0 +1,114 @@
+package vastflow
+
+import (
+	"errors"
+	"github.com/jack0liu/logs"
+	"sync"
+)
+
+const (
+	compensationDone   = "compensated"
+	compensationFailed = "failed"
+)
+
+// Compensator is implemented by rivers able to undo what they did. When the andes fails,
+// rivers succeeded are compensated in reverse order, branches of parallel rivers concurrently,
+// before the atlantic runs. A river is compensated once even if the andes is resumed.
+type Compensator interface {
+	Compensate(headwaters *Headwaters) error
+}
+
+type compensable interface {
+	Compensator
+	getCompensation() string
+	setCompensation(state string)
+}
+
+// runFailure compensates rivers of the andes, then fails the atlantic
+func runFailure(headwaters *Headwaters) {
+	if headwaters.first != nil {
+		compensateChain(headwaters, headwaters.first)
+	}
+	headwaters.atlantic.runFail(headwaters, atlanticFlowOf(headwaters.atlantic))
+}
+
+func compensateChain(headwaters *Headwaters, first Stream) {
+	chain := make([]Stream, 0)
+	for s := first; s != nil; s = s.next() {
+		chain = append(chain, s)
+	}
+	for i := len(chain) - 1; i >= 0; i-- {
+		compensateStream(headwaters, chain[i])
+	}
+}
+
+func compensateStream(headwaters *Headwaters, stream Stream) {
+	switch s := stream.(type) {
+	case ParallelStream:
+		var wg sync.WaitGroup
+		for _, r := range s.getRivers() {
+			wg.Add(1)
+			go func(r Stream) {
+				defer wg.Done()
+				compensateChain(headwaters, r)
+			}(r)
+		}
+		wg.Wait()
+	case ChoiceStream:
+		_, branches := s.getBranches()
+		for _, r := range branches {
+			compensateChain(headwaters, r)
+		}
+	case MapStream:
+		var wg sync.WaitGroup
+		for _, r := range s.getItems() {
+			wg.Add(1)
+			go func(r Stream) {
+				defer wg.Done()
+				compensateChain(basinHeadwaters(headwaters, r), r)
+			}(r)
+		}
+		wg.Wait()
+	case BasinStream:
+		if first := s.getFirstDream(); first != nil {
+			compensateChain(basinHeadwaters(headwaters, first), first)
+		}
+	case compensable:
+		if stream.getState() != stateSuccess || len(s.getCompensation()) > 0 {
+			return
+		}
+		state := compensationDone
+		if err := callCompensate(headwaters, s); err != nil {
+			logs.Error("[%s][%s]compensate fail, err:%s", headwaters.RequestId, stream.GetColor(), err.Error())
+			state = compensationFailed
+		}
+		s.setCompensation(state)
+		if err := setFlowCompensation(headwaters, stream.getId(), state); err != nil {
+			logs.Error("[%s]update compensation fail, err:%s", headwaters.RequestId, err.Error())
+		}
+	}
+}
+
+func callCompensate(headwaters *Headwaters, c Compensator) (err error) {
+	defer func() {
+		if e := recover(); e != nil {
+			logs.Error("[%s]%v", headwaters.RequestId, e)
+			PrintStack()
+			err = errors.New("got an panic")
+		}
+	}()
+	return c.Compensate(headwaters)
+}
+
+// basinHeadwaters restores the water rivers of a basin ran with
+func basinHeadwaters(headwaters *Headwaters, first Stream) *Headwaters {
+	e := headwaters.eng()
+	if fw := e.queryWaterById(first.getWaterId()); fw != nil {
+		if hw := e.fromPersistWater(fw.Headwaters); hw != nil {
+			hw.atlantic = headwaters.atlantic
+			hw.setJob(headwaters.jobRequestId(), headwaters.getFence())
+			return hw
+		}
+	}
+	return headwaters
+}
@@ -0,0 +1,123 @@
+package vastflow
+
+import (
+	"context"
+	"reflect"
+	"time"
+)
+
+// ContextRiverFlow is RiverFlow receiving a context, which is canceled when headwaters or
+// its basin is canceled, the andes deadline exceeds or the unit shuts down. Rivers of atomic
+// attr get a context never canceled. Rivers implement either RiverFlow or ContextRiverFlow.
+type ContextRiverFlow interface {
+	Update(attr *RiverAttr)
+	FlowContext(ctx context.Context, headwaters *Headwaters) (errCause string, err error)
+	CycleContext(ctx context.Context, headwaters *Headwaters) (errCause string, err error)
+}
+
+// ContextAtlanticFlow is AtlanticFlow receiving a context canceled when the unit shuts down
+type ContextAtlanticFlow interface {
+	SuccessContext(ctx context.Context, headwaters *Headwaters) error
+	FailContext(ctx context.Context, headwaters *Headwaters) error
+}
+
+// contextRiverFlow adapts ContextRiverFlow to RiverFlow
+type contextRiverFlow struct {
+	flow         ContextRiverFlow
+	atomic       bool
+	flowTimeout  time.Duration
+	cycleTimeout time.Duration
+}
+
+func (cf *contextRiverFlow) Update(attr *RiverAttr) {
+	cf.flow.Update(attr)
+	cf.atomic = attr.Atomic
+	cf.flowTimeout = attr.FlowTimeout
+	cf.cycleTimeout = attr.CycleTimeout
+}
+
+func (cf *contextRiverFlow) Flow(headwaters *Headwaters) (errCause string, err error) {
+	return cf.call(headwaters, cf.flowTimeout, cf.flow.FlowContext)
+}
+
+func (cf *contextRiverFlow) Cycle(headwaters *Headwaters) (errCause string, err error) {
+	return cf.call(headwaters, cf.cycleTimeout, cf.flow.CycleContext)
+}
+
+func (cf *contextRiverFlow) call(headwaters *Headwaters, timeout time.Duration,
+	f func(ctx context.Context, headwaters *Headwaters) (string, error)) (errCause string, err error) {
+	ctx, cancel := headwaters.flowContext(cf.atomic)
+	defer cancel()
+	callCtx := ctx
+	if timeout > 0 {
+		// canceled when the call returns or is abandoned
+		var cancelTimeout context.CancelFunc
+		callCtx, cancelTimeout = context.WithTimeout(ctx, timeout)
+		defer cancelTimeout()
+	}
+	errCause, err = callTimeout(headwaters, timeout, func(headwaters *Headwaters) (string, error) {
+		return f(callCtx, headwaters)
+	})
+	if err == ErrorTimeout {
+		return errCause, err
+	}
+	if err != nil && callCtx.Err() != nil && ctx.Err() == nil {
+		// returned before the river abandons it
+		return errCause, ErrorTimeout
+	}
+	if err != nil && ctx.Err() != nil && headwaters.Err() == nil && headwaters.basinError() == nil &&
+		headwaters.eng().isShuttingDown() {
+		// interrupted by shutdown, not failed, others resume it
+		return "", ErrorShutdown
+	}
+	return errCause, err
+}
+
+// contextAtlanticFlow adapts ContextAtlanticFlow to AtlanticFlow
+type contextAtlanticFlow struct {
+	flow ContextAtlanticFlow
+}
+
+func (ca *contextAtlanticFlow) Success(headwaters *Headwaters) error {
+	ctx, cancel := headwaters.stopContext()
+	defer cancel()
+	return ca.flow.SuccessContext(ctx, headwaters)
+}
+
+func (ca *contextAtlanticFlow) Fail(headwaters *Headwaters) error {
+	ctx, cancel := headwaters.stopContext()
+	defer cancel()
+	return ca.flow.FailContext(ctx, headwaters)
+}
+
+// riverFlowOf gets RiverFlow of the stream, nil if it implements neither flow interface
+func riverFlowOf(stream interface{}) RiverFlow {
+	if flow, ok := stream.(RiverFlow); ok {
+		return flow
+	}
+	if flow, ok := stream.(ContextRiverFlow); ok {
+		return &contextRiverFlow{flow: flow}
+	}
+	return nil
+}
+
+func atlanticFlowOf(atlantic interface{}) AtlanticFlow {
+	if flow, ok := atlantic.(AtlanticFlow); ok {
+		return flow
+	}
+	if flow, ok := atlantic.(ContextAtlanticFlow); ok {
+		return &contextAtlanticFlow{flow: flow}
+	}
+	return nil
+}
+
+// flowType is the user type of flow, not the adapter
+func flowType(flow interface{}) reflect.Type {
+	switch f := flow.(type) {
+	case *contextRiverFlow:
+		flow = f.flow
+	case *contextAtlanticFlow:
+		flow = f.flow
+	}
+	return reflect.ValueOf(flow).Elem().Type()
+}
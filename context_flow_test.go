@@ -0,0 +1,46 @@
+package vastflow
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+// stubContextFlow blocks in FlowContext until release, ignoring ctx
+type stubContextFlow struct {
+	release  chan struct{}
+	canceled chan struct{}
+}
+
+func (s *stubContextFlow) Update(attr *RiverAttr) {}
+
+func (s *stubContextFlow) FlowContext(ctx context.Context, headwaters *Headwaters) (string, error) {
+	<-s.release
+	if ctx.Err() != nil {
+		close(s.canceled)
+	}
+	return "", nil
+}
+
+func (s *stubContextFlow) CycleContext(ctx context.Context, headwaters *Headwaters) (string, error) {
+	return "", nil
+}
+
+func TestContextFlowAbandoned(t *testing.T) {
+	stub := &stubContextFlow{release: make(chan struct{}), canceled: make(chan struct{})}
+	flow := riverFlowOf(stub)
+	flow.Update(&RiverAttr{FlowTimeout: 50 * time.Millisecond})
+	start := time.Now()
+	if _, err := flow.Flow(NewHeadwaters("context-timeout")); err != ErrorTimeout {
+		t.Fatalf("err = %v, want %v", err, ErrorTimeout)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Fatalf("flow ignoring ctx waited %v", elapsed)
+	}
+	close(stub.release)
+	select {
+	case <-stub.canceled:
+	case <-time.After(time.Second):
+		t.Fatalf("ctx of the abandoned call not canceled")
+	}
+}
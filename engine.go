@@ -0,0 +1,94 @@
+package vastflow
+
+import (
+	"github.com/astaxie/beego/orm"
+	"github.com/jack0liu/logs"
+	"reflect"
+	"sync"
+)
+
+const defaultDbAlias = "default"
+
+// Engine owns its store, registry, flow window and unit identity, engines in one process
+// don't interfere with each other. Package functions work on the default engine.
+type Engine struct {
+	// store
+	dbAlias    string
+	initDbLock sync.Mutex
+	initDbDone uint32
+
+	// registry, falls back to the default engine's
+	registerMu    sync.RWMutex
+	streamTypes   map[string]reflect.Type
+	atlanticTypes map[string]reflect.Type
+
+	// window and queue
+	wnd            *FlowWnd
+	admission      Admission // nil means the window itself
+	maxJobAttempts int
+
+	// unit
+	heartOnce      sync.Once
+	checkOnce      sync.Once
+	shrinkOnce     sync.Once
+	unit           string
+	epoch          int64
+	intervalSec    int
+	leaseSec       int
+	labelsMu       sync.RWMutex
+	labels         []string // replaced as a whole under labelsMu, never changed in place
+	replicateTimes int
+	deadTimes      int
+
+	autoRecover     bool
+	recoveryHandler func(report *RecoveryReport)
+
+	leading      int32
+	leaderUntil  int64 // unix nano, local time the leader lease is trusted until
+	shuttingDown int32
+	fenced       int32         // another process registered this unit
+	stopping     chan struct{} // closed when shutdown begins
+	heartStop    chan struct{} // closed to stop background goroutines
+	heartWg      sync.WaitGroup
+	runningCount int64 // streams are running in this unit
+}
+
+var defaultEngine = NewEngine(defaultDbAlias)
+
+// NewEngine creates an engine on a beego db alias, the alias is registered by InitDb.
+// beego always needs the "default" alias, so register it before other engines work.
+func NewEngine(dbAlias string) *Engine {
+	if len(dbAlias) == 0 {
+		dbAlias = defaultDbAlias
+	}
+	return &Engine{
+		dbAlias:        dbAlias,
+		streamTypes:    make(map[string]reflect.Type),
+		atlanticTypes:  make(map[string]reflect.Type),
+		wnd:            newFlowWnd(),
+		maxJobAttempts: DefaultMaxAttempts,
+		replicateTimes: defaultReplicateTimes,
+		deadTimes:      defaultDeadTimes,
+		stopping:       make(chan struct{}),
+		heartStop:      make(chan struct{}),
+	}
+}
+
+func DefaultEngine() *Engine {
+	return defaultEngine
+}
+
+// NewAndes draws an andes run by this engine
+func (e *Engine) NewAndes() *Andes {
+	return &Andes{engine: e}
+}
+
+func (e *Engine) newOrm() orm.Ormer {
+	o := orm.NewOrm()
+	if e.dbAlias != defaultDbAlias {
+		if err := o.Using(e.dbAlias); err != nil {
+			logs.Error("using db alias(%s) fail, err:%s", e.dbAlias, err.Error())
+		}
+	}
+	return o
+}
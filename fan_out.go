@@ -0,0 +1,253 @@
+package vastflow
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/jack0liu/logs"
+	"strings"
+	"sync"
+)
+
+// FailPolicy decides how a fan-out river handles failed branches
+type FailPolicy string
+
+const (
+	FailFast   FailPolicy = "fail_fast"   // cancel other branches on the first failure, by default
+	WaitAll    FailPolicy = "wait_all"    // wait for all branches, then fail if any failed
+	Quorum     FailPolicy = "quorum"      // succeed if at least Quorum branches succeed
+	BestEffort FailPolicy = "best_effort" // ignore failed branches
+)
+
+const (
+	outcomeSuccess  = "success"
+	outcomeFail     = "fail"
+	outcomeCanceled = "canceled"
+)
+
+// StreamOption is saved with the stream, so a reloaded stream runs the same
+type StreamOption struct {
+	MaxConcurrency int        `json:",omitempty"` // branches running at a time, 0 means no limit
+	Policy         FailPolicy `json:",omitempty"`
+	Quorum         int        `json:",omitempty"` // branches must succeed with Quorum policy
+	OutcomeKey     string     `json:",omitempty"` // headwaters key of branch outcomes
+}
+
+// BranchOutcome is the result of one branch of a fan-out river, outcomes are put in headwaters
+// under BranchOutcomeKey after branches finish
+type BranchOutcome struct {
+	Index int
+	State string // success, fail or canceled
+	Error string `json:",omitempty"`
+}
+
+// BranchOutcomeKey is the headwaters key of branch outcomes of a parallel or map river, the one
+// set by SetOutcomeKey, or one of the river id
+func BranchOutcomeKey(river Stream) string {
+	if oh, ok := river.(optionHolder); ok && len(oh.getOption().OutcomeKey) > 0 {
+		return oh.getOption().OutcomeKey
+	}
+	return "branch_outcomes." + river.getId()
+}
+
+// BranchOutcomes reads branch outcomes of key from headwaters, also from a restored one
+func BranchOutcomes(headwaters *Headwaters, key string) []BranchOutcome {
+	v := headwaters.Get(key)
+	if v == nil {
+		return nil
+	}
+	if outcomes, ok := v.([]BranchOutcome); ok {
+		return outcomes
+	}
+	b, err := json.Marshal(v)
+	if err != nil {
+		logs.Error("marshal branch outcomes fail, err:%s", err.Error())
+		return nil
+	}
+	var outcomes []BranchOutcome
+	if err := json.Unmarshal(b, &outcomes); err != nil {
+		logs.Error("invalid branch outcomes:%s, err:%s", string(b), err.Error())
+		return nil
+	}
+	return outcomes
+}
+
+type optionHolder interface {
+	getOption() StreamOption
+	setOption(option StreamOption)
+}
+
+func optionOf(s Stream) string {
+	oh, ok := s.(optionHolder)
+	if !ok {
+		return ""
+	}
+	option := oh.getOption()
+	if option == (StreamOption{}) {
+		return ""
+	}
+	b, err := json.Marshal(&option)
+	if err != nil {
+		logs.Error("marshal stream option fail, err:%s", err.Error())
+		return ""
+	}
+	return string(b)
+}
+
+func setOptionInfo(s Stream, option string) {
+	oh, ok := s.(optionHolder)
+	if !ok || len(option) == 0 {
+		return
+	}
+	var so StreamOption
+	if err := json.Unmarshal([]byte(option), &so); err != nil {
+		logs.Error("invalid stream option:%s, err:%s", option, err.Error())
+		return
+	}
+	oh.setOption(so)
+}
+
+// chainState tells if every stream of the chain succeeded, or the stream failed
+func chainState(first Stream) (streamState, Stream) {
+	for s := first; s != nil; s = s.next() {
+		switch s.getState() {
+		case stateSuccess:
+			continue
+		case stateFail:
+			return stateFail, s
+		default:
+			return stateRunning, nil
+		}
+	}
+	return stateSuccess, nil
+}
+
+// canceledError tells if a branch stopped for the canceled scope, rivers prefix the cause with flow type
+func canceledError(err error) bool {
+	for _, c := range []error{ErrorCanceled, ErrorBasinCanceled, context.Canceled} {
+		if err == c || strings.HasSuffix(err.Error(), c.Error()) {
+			return true
+		}
+	}
+	return false
+}
+
+// fanOut runs branches with at most MaxConcurrency at a time, starting pending ones as others
+// finish, branches done before restart are skipped. Branches run in a scope of headwaters,
+// which Policy cancels on failures, so nested fan-outs never cancel the enclosing ones. It
+// stops starting branches once the scope is canceled, and returns ErrorShutdown if some are
+// left for shutdown.
+func fanOut(headwaters *Headwaters, branches []Stream, option StreamOption,
+	run func(scope *Headwaters, i int) error) ([]BranchOutcome, error) {
+	if option.Policy == Quorum && (option.Quorum <= 0 || option.Quorum > len(branches)) {
+		return nil, fmt.Errorf("quorum %d is invalid for %d branches", option.Quorum, len(branches))
+	}
+	scope, release := headwaters.scope()
+	defer release()
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	var slots chan struct{}
+	if option.MaxConcurrency > 0 {
+		slots = make(chan struct{}, option.MaxConcurrency)
+	}
+	failFast := option.Policy != WaitAll && option.Policy != Quorum && option.Policy != BestEffort
+	outcomes := make([]BranchOutcome, len(branches))
+	failedBefore := make([]bool, len(branches))
+	failed := 0
+	parked := false
+	done := func(i int, err error) {
+		mu.Lock()
+		defer mu.Unlock()
+		switch {
+		case err == nil:
+			outcomes[i].State = outcomeSuccess
+		case err == ErrorShutdown:
+			parked = true
+		case !failedBefore[i] && canceledError(err):
+			// stopped by the canceled scope, it's not a failure
+		default:
+			// failed, even if the scope was canceled meanwhile
+			outcomes[i].State = outcomeFail
+			outcomes[i].Error = err.Error()
+			failed++
+			if failFast {
+				scope.Cancel(err)
+			} else if option.Policy == Quorum && len(branches)-failed < option.Quorum {
+				scope.Cancel(fmt.Errorf("quorum %d of %d unreachable, %s", option.Quorum, len(branches), err.Error()))
+			}
+		}
+	}
+loop:
+	for i, branch := range branches {
+		outcomes[i] = BranchOutcome{Index: i, State: outcomeCanceled}
+		state, failedStream := chainState(branch)
+		if state == stateSuccess {
+			outcomes[i].State = outcomeSuccess
+			continue
+		}
+		failedBefore[i] = state == stateFail
+		if state == stateFail && !failFast {
+			// failed before restart, running it again cancels the scope
+			errStr := "flow has been failed"
+			if flow := headwaters.eng().queryFlowById(failedStream.getId()); flow != nil && len(flow.Error) > 0 {
+				errStr = flow.Error
+			}
+			done(i, errors.New(errStr))
+			continue
+		}
+		if slots != nil {
+			select {
+			case slots <- struct{}{}:
+			case <-scope.Done():
+				break loop
+			case <-scope.basinFinish():
+				break loop
+			case <-headwaters.eng().stopping:
+				mu.Lock()
+				parked = true
+				mu.Unlock()
+				break loop
+			}
+		}
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			done(i, run(scope, i))
+			if slots != nil {
+				<-slots
+			}
+		}(i)
+	}
+	wg.Wait()
+	for i := range outcomes {
+		// not reached for cancel or shutdown
+		if len(outcomes[i].State) == 0 {
+			outcomes[i] = BranchOutcome{Index: i, State: outcomeCanceled}
+		}
+	}
+	if parked {
+		return outcomes, ErrorShutdown
+	}
+	if err := scope.Err(); err != nil && headwaters.Err() == nil {
+		// canceled by policy
+		return outcomes, err
+	}
+	switch option.Policy {
+	case WaitAll:
+		if failed > 0 {
+			return outcomes, fmt.Errorf("%d of %d branches failed", failed, len(branches))
+		}
+	case Quorum:
+		succeeded := 0
+		for _, outcome := range outcomes {
+			if outcome.State == outcomeSuccess {
+				succeeded++
+			}
+		}
+		if succeeded < option.Quorum {
+			return outcomes, fmt.Errorf("%d of %d branches succeeded, quorum is %d", succeeded, len(branches), option.Quorum)
+		}
+	}
+	return outcomes, nil
+}
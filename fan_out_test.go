@@ -0,0 +1,215 @@
+package vastflow
+
+import (
+	"errors"
+	"fmt"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// stubBranch is a branch fanOut only reads the state of
+type stubBranch struct {
+	state streamState
+}
+
+func (s *stubBranch) Run(waters *Headwaters, flow RiverFlow, syncNext bool) error { return nil }
+func (s *stubBranch) SetDownStream(down Stream)                                   {}
+func (s *stubBranch) next() Stream                                                { return nil }
+func (s *stubBranch) setInner()                                                   {}
+func (s *stubBranch) setId(id string)                                             {}
+func (s *stubBranch) getId() string                                               { return "" }
+func (s *stubBranch) setColor(color string)                                       {}
+func (s *stubBranch) colorCurrent(color string)                                   {}
+func (s *stubBranch) GetColor() string                                            { return "" }
+func (s *stubBranch) setState(state streamState)                                  { s.state = state }
+func (s *stubBranch) getState() streamState                                       { return s.state }
+func (s *stubBranch) setWaterId(waterId string)                                   {}
+func (s *stubBranch) getWaterId() string                                          { return "" }
+
+func stubBranches(n int) []Stream {
+	branches := make([]Stream, n)
+	for i := range branches {
+		branches[i] = &stubBranch{}
+	}
+	return branches
+}
+
+const (
+	runOk       = "ok"
+	runFail     = "fail"
+	runWait     = "wait"      // succeeds later unless the scope is canceled
+	runFailLate = "fail-late" // fails once the scope is canceled
+	runFailed   = "failed"    // failed before restart, cancels the scope like a river in stateFail
+)
+
+// branchesOf makes branches for behaviors, failed ones in stateFail
+func branchesOf(behaviors []string) []Stream {
+	branches := stubBranches(len(behaviors))
+	for i, behavior := range behaviors {
+		if behavior == runFailed {
+			branches[i].setState(stateFail)
+		}
+	}
+	return branches
+}
+
+// stubRun runs branches as told, a canceled one returns its own error like rivers do
+func stubRun(behaviors []string) func(scope *Headwaters, i int) error {
+	return func(scope *Headwaters, i int) error {
+		switch behaviors[i] {
+		case runFail:
+			return errors.New("branch failed")
+		case runFailed:
+			err := errors.New("flow has been failed")
+			scope.Cancel(err)
+			return err
+		case runFailLate:
+			<-scope.Done()
+			return errors.New("branch failed")
+		case runWait:
+			select {
+			case <-scope.Done():
+				return fmt.Errorf("*vastflow.stubFlow:%s", ErrorCanceled.Error())
+			case <-time.After(200 * time.Millisecond):
+				return nil
+			}
+		}
+		return nil
+	}
+}
+
+func outcomeStates(outcomes []BranchOutcome) []string {
+	states := make([]string, len(outcomes))
+	for i, o := range outcomes {
+		states[i] = o.State
+	}
+	return states
+}
+
+func TestFanOutPolicies(t *testing.T) {
+	tests := []struct {
+		name      string
+		option    StreamOption
+		behaviors []string
+		wantErr   bool
+		want      []string
+	}{
+		{"fail fast cancels others", StreamOption{}, []string{runFail, runWait, runWait},
+			true, []string{outcomeFail, outcomeCanceled, outcomeCanceled}},
+		{"fail fast failed before restart", StreamOption{}, []string{runFailed, runWait},
+			true, []string{outcomeFail, outcomeCanceled}},
+		{"fail fast failure racing cancel", StreamOption{}, []string{runFail, runFailLate, runWait},
+			true, []string{outcomeFail, outcomeFail, outcomeCanceled}},
+		{"fail fast all succeed", StreamOption{Policy: FailFast}, []string{runOk, runOk},
+			false, []string{outcomeSuccess, outcomeSuccess}},
+		{"wait all", StreamOption{Policy: WaitAll}, []string{runOk, runFail, runWait},
+			true, []string{outcomeSuccess, outcomeFail, outcomeSuccess}},
+		{"quorum reached", StreamOption{Policy: Quorum, Quorum: 2}, []string{runOk, runFail, runOk},
+			false, []string{outcomeSuccess, outcomeFail, outcomeSuccess}},
+		{"quorum unreachable", StreamOption{Policy: Quorum, Quorum: 3}, []string{runFail, runWait, runWait},
+			true, []string{outcomeFail, outcomeCanceled, outcomeCanceled}},
+		{"best effort", StreamOption{Policy: BestEffort}, []string{runFail, runFail, runOk},
+			false, []string{outcomeFail, outcomeFail, outcomeSuccess}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			hw := NewHeadwaters("fan-out-policy")
+			outcomes, err := fanOut(hw, branchesOf(tt.behaviors), tt.option, stubRun(tt.behaviors))
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("err = %v, want err %v", err, tt.wantErr)
+			}
+			got := outcomeStates(outcomes)
+			for i := range tt.want {
+				if got[i] != tt.want[i] {
+					t.Fatalf("outcomes = %v, want %v", got, tt.want)
+				}
+			}
+			if hw.Err() != nil {
+				t.Fatalf("headwaters canceled by fan-out, err:%v", hw.Err())
+			}
+		})
+	}
+}
+
+func TestFanOutInvalidQuorum(t *testing.T) {
+	for _, quorum := range []int{0, 4} {
+		option := StreamOption{Policy: Quorum, Quorum: quorum}
+		if _, err := fanOut(NewHeadwaters("fan-out-quorum"), stubBranches(3), option, stubRun(nil)); err == nil {
+			t.Fatalf("quorum %d of 3 accepted", quorum)
+		}
+	}
+}
+
+func TestFanOutNestedScope(t *testing.T) {
+	hw := NewHeadwaters("fan-out-nested")
+	inner := []string{runFail, runWait}
+	outer := func(scope *Headwaters, i int) error {
+		if i == 0 {
+			_, err := fanOut(scope, stubBranches(len(inner)), StreamOption{}, stubRun(inner))
+			return err
+		}
+		return stubRun([]string{runWait, runWait})(scope, i)
+	}
+	outcomes, err := fanOut(hw, stubBranches(2), StreamOption{Policy: BestEffort}, outer)
+	if err != nil {
+		t.Fatalf("err = %v", err)
+	}
+	got := outcomeStates(outcomes)
+	if got[0] != outcomeFail || got[1] != outcomeSuccess {
+		t.Fatalf("outcomes = %v, inner failure leaked to the outer scope", got)
+	}
+}
+
+func TestFanOutMaxConcurrency(t *testing.T) {
+	const branches, limit = 10, 3
+	var running, peak, ran int32
+	run := func(scope *Headwaters, i int) error {
+		n := atomic.AddInt32(&running, 1)
+		for {
+			p := atomic.LoadInt32(&peak)
+			if n <= p || atomic.CompareAndSwapInt32(&peak, p, n) {
+				break
+			}
+		}
+		time.Sleep(10 * time.Millisecond)
+		atomic.AddInt32(&running, -1)
+		atomic.AddInt32(&ran, 1)
+		return nil
+	}
+	outcomes, err := fanOut(NewHeadwaters("fan-out-limit"), stubBranches(branches), StreamOption{MaxConcurrency: limit}, run)
+	if err != nil {
+		t.Fatalf("err = %v", err)
+	}
+	if peak > limit {
+		t.Fatalf("%d branches ran at a time, limit is %d", peak, limit)
+	}
+	if ran != branches {
+		t.Fatalf("%d branches ran, want %d", ran, branches)
+	}
+	for _, o := range outcomes {
+		if o.State != outcomeSuccess {
+			t.Fatalf("outcomes = %v", outcomeStates(outcomes))
+		}
+	}
+}
+
+func TestFanOutSkipsDone(t *testing.T) {
+	branches := stubBranches(3)
+	branches[1].setState(stateSuccess)
+	var ran int32
+	run := func(scope *Headwaters, i int) error {
+		if i == 1 {
+			t.Errorf("branch done before restart ran again")
+		}
+		atomic.AddInt32(&ran, 1)
+		return nil
+	}
+	outcomes, err := fanOut(NewHeadwaters("fan-out-resume"), branches, StreamOption{MaxConcurrency: 1}, run)
+	if err != nil {
+		t.Fatalf("err = %v", err)
+	}
+	if ran != 2 || outcomes[1].State != outcomeSuccess {
+		t.Fatalf("ran %d, outcomes = %v", ran, outcomeStates(outcomes))
+	}
+}
@@ -1,11 +1,13 @@
 package vastflow
 
 import (
+	"context"
 	"errors"
 	"github.com/jack0liu/logs"
 	"github.com/satori/go.uuid"
 	"reflect"
 	"sync"
+	"time"
 )
 
 type errorBasin struct {
@@ -17,6 +19,11 @@ type Headwaters struct {
 	RequestId string
 	ReqInfo   interface{} // request info from andes
 	atlantic  AtlanticStream
+	deadline  time.Time // zero means no deadline
+	fence     int64     // fencing token of the job, not persist
+	job       string    // request id of the job holding the fence if it's not RequestId, not persist
+	engine    *Engine   // engine running the andes, not persist
+	first     Stream    // first stream of the andes, used to compensate, not persist
 
 	// basin context
 	basinMu   *sync.Mutex
@@ -33,6 +40,9 @@ type Headwaters struct {
 	// tmp context , not persist
 	tmpMu      sync.RWMutex
 	tmpContext map[string]interface{}
+
+	// set on the scope of a fan-out, which has its own done and err, others are of parent
+	parent *Headwaters
 }
 
 // closedChan is a reusable closed channel.
@@ -60,6 +70,7 @@ func NewHeadwaters(requestId string) *Headwaters {
 }
 
 func (hw *Headwaters) Put(key string, val interface{}) {
+	hw = hw.root()
 	hw.mu.Lock()
 	defer hw.mu.Unlock()
 	if hw.context == nil {
@@ -69,6 +80,7 @@ func (hw *Headwaters) Put(key string, val interface{}) {
 }
 
 func (hw *Headwaters) Del(key string) {
+	hw = hw.root()
 	hw.mu.Lock()
 	defer hw.mu.Unlock()
 	if hw.context == nil {
@@ -78,12 +90,15 @@ func (hw *Headwaters) Del(key string) {
 }
 
 func (hw *Headwaters) Replace(other *Headwaters) {
+	hw = hw.root()
+	other = other.root()
 	hw.mu.Lock()
 	defer hw.mu.Unlock()
 	hw.context = other.context
 }
 
 func (hw *Headwaters) Get(key string) interface{} {
+	hw = hw.root()
 	hw.mu.RLock()
 	defer hw.mu.RUnlock()
 	if hw.context == nil {
@@ -94,6 +109,7 @@ func (hw *Headwaters) Get(key string) interface{} {
 }
 
 func (hw *Headwaters) GetInt(key string) int {
+	hw = hw.root()
 	hw.mu.RLock()
 	defer hw.mu.RUnlock()
 	if hw.context == nil {
@@ -113,6 +129,7 @@ func (hw *Headwaters) GetInt(key string) int {
 }
 
 func (hw *Headwaters) GetString(key string) string {
+	hw = hw.root()
 	hw.mu.RLock()
 	defer hw.mu.RUnlock()
 	if hw.context == nil {
@@ -131,6 +148,7 @@ func (hw *Headwaters) GetString(key string) string {
 }
 
 func (hw *Headwaters) GetAll() map[string]interface{} {
+	hw = hw.root()
 	hw.mu.RLock()
 	defer hw.mu.RUnlock()
 	if hw.context == nil {
@@ -139,6 +157,59 @@ func (hw *Headwaters) GetAll() map[string]interface{} {
 	return hw.context
 }
 
+// snapshot copies the context, the copy can be read without lock
+func (hw *Headwaters) snapshot() map[string]interface{} {
+	hw = hw.root()
+	hw.mu.RLock()
+	defer hw.mu.RUnlock()
+	out := make(map[string]interface{}, len(hw.context))
+	for k, v := range hw.context {
+		out[k] = v
+	}
+	return out
+}
+
+// root is the headwaters holding context, scopes share it
+func (hw *Headwaters) root() *Headwaters {
+	for hw.parent != nil {
+		hw = hw.parent
+	}
+	return hw
+}
+
+// scope derives headwaters sharing context with hw, it's canceled with hw, or alone so a
+// fan-out cancels its own branches only. release stops following hw.
+func (hw *Headwaters) scope() (scope *Headwaters, release func()) {
+	scope = &Headwaters{
+		RequestId: hw.RequestId,
+		ReqInfo:   hw.ReqInfo,
+		atlantic:  hw.atlantic,
+		engine:    hw.engine,
+		first:     hw.first,
+
+		basinMu:   hw.basinMu,
+		basinDone: hw.basinDone,
+		basinErr:  hw.basinErr,
+
+		id:     hw.id,
+		done:   make(chan struct{}),
+		parent: hw,
+	}
+	stop := make(chan struct{})
+	go func() {
+		select {
+		case <-stop:
+		case <-hw.Done():
+			err := hw.Err()
+			if err == nil {
+				err = ErrorCanceled
+			}
+			scope.Cancel(err)
+		}
+	}()
+	return scope, func() { close(stop) }
+}
+
 func (hw *Headwaters) Cancel(err error) {
 	hw.mu.Lock()
 	defer hw.mu.Unlock()
@@ -155,15 +226,21 @@ func (hw *Headwaters) Cancel(err error) {
 
 func (hw *Headwaters) Done() <-chan struct{} {
 	hw.mu.RLock()
-	defer hw.mu.RUnlock()
-	if hw.err != nil {
-		hw.done = closedChan
+	d := hw.done
+	hw.mu.RUnlock()
+	if d != nil {
+		return d
 	}
+	hw.mu.Lock()
+	defer hw.mu.Unlock()
 	if hw.done == nil {
-		hw.done = make(chan struct{})
+		if hw.err != nil {
+			hw.done = closedChan
+		} else {
+			hw.done = make(chan struct{})
+		}
 	}
-	d := hw.done
-	return d
+	return hw.done
 }
 
 func (hw *Headwaters) Err() error {
@@ -173,7 +250,103 @@ func (hw *Headwaters) Err() error {
 	return err
 }
 
+func (hw *Headwaters) SetDeadline(deadline time.Time) {
+	hw = hw.root()
+	hw.mu.Lock()
+	defer hw.mu.Unlock()
+	hw.deadline = deadline.UTC()
+}
+
+func (hw *Headwaters) Deadline() (deadline time.Time, ok bool) {
+	hw = hw.root()
+	hw.mu.RLock()
+	defer hw.mu.RUnlock()
+	return hw.deadline, !hw.deadline.IsZero()
+}
+
+func (hw *Headwaters) setFence(fence int64) {
+	hw = hw.root()
+	hw.mu.Lock()
+	defer hw.mu.Unlock()
+	hw.fence = fence
+}
+
+func (hw *Headwaters) getFence() int64 {
+	hw = hw.root()
+	hw.mu.RLock()
+	defer hw.mu.RUnlock()
+	return hw.fence
+}
+
+// setJob fences writes by the job of requestId, a child andes runs under the job of its parent
+func (hw *Headwaters) setJob(requestId string, fence int64) {
+	hw = hw.root()
+	hw.mu.Lock()
+	defer hw.mu.Unlock()
+	hw.job = requestId
+	hw.fence = fence
+}
+
+// jobRequestId is the request id of the job fencing writes
+func (hw *Headwaters) jobRequestId() string {
+	hw = hw.root()
+	hw.mu.RLock()
+	defer hw.mu.RUnlock()
+	if len(hw.job) == 0 {
+		return hw.RequestId
+	}
+	return hw.job
+}
+
+func (hw *Headwaters) eng() *Engine {
+	if hw.engine == nil {
+		return defaultEngine
+	}
+	return hw.engine
+}
+
+// flowContext is canceled when headwaters or basin is canceled, deadline exceeds or unit stops.
+// atomic gets a context never canceled.
+func (hw *Headwaters) flowContext(atomic bool) (context.Context, context.CancelFunc) {
+	if atomic {
+		return context.WithCancel(context.Background())
+	}
+	var ctx context.Context
+	var cancel context.CancelFunc
+	if deadline, ok := hw.Deadline(); ok {
+		ctx, cancel = context.WithDeadline(context.Background(), deadline)
+	} else {
+		ctx, cancel = context.WithCancel(context.Background())
+	}
+	done, basinDone, stopping := hw.Done(), hw.basinFinish(), hw.eng().stopping
+	go func() {
+		select {
+		case <-ctx.Done():
+		case <-done:
+		case <-basinDone:
+		case <-stopping:
+		}
+		cancel()
+	}()
+	return ctx, cancel
+}
+
+// stopContext is canceled when unit stops
+func (hw *Headwaters) stopContext() (context.Context, context.CancelFunc) {
+	ctx, cancel := context.WithCancel(context.Background())
+	stopping := hw.eng().stopping
+	go func() {
+		select {
+		case <-ctx.Done():
+		case <-stopping:
+		}
+		cancel()
+	}()
+	return ctx, cancel
+}
+
 func (hw *Headwaters) copy4Basin() *Headwaters {
+	hw = hw.root()
 	newContext := make(map[string]interface{}, 0)
 	newTmpContext := make(map[string]interface{}, 0)
 	hw.mu.RLock()
@@ -192,6 +365,11 @@ func (hw *Headwaters) copy4Basin() *Headwaters {
 		RequestId: hw.RequestId,
 		ReqInfo:   hw.ReqInfo,
 		atlantic:  hw.atlantic,
+		deadline:  hw.deadline,
+		fence:     hw.fence,
+		job:       hw.job,
+		engine:    hw.engine,
+		first:     hw.first,
 
 		basinMu:   hw.basinMu,
 		basinDone: hw.basinDone,
@@ -208,6 +386,7 @@ func (hw *Headwaters) copy4Basin() *Headwaters {
 }
 
 func (hw *Headwaters) TmpPut(key string, value string) {
+	hw = hw.root()
 	hw.tmpMu.Lock()
 	defer hw.tmpMu.Unlock()
 	if hw.tmpContext == nil {
@@ -217,6 +396,7 @@ func (hw *Headwaters) TmpPut(key string, value string) {
 }
 
 func (hw *Headwaters) TmpGet(key string) string {
+	hw = hw.root()
 	hw.tmpMu.RLock()
 	defer hw.tmpMu.RUnlock()
 	if hw.tmpContext == nil {
@@ -9,30 +9,31 @@ import (
 	"github.com/jack0liu/logs"
 	"github.com/jack0liu/utils"
 	"path/filepath"
-	"sync"
 	"sync/atomic"
+	"time"
 )
 
-var (
-	initDbLock sync.Mutex
-	initDbDone uint32
-)
+const dbTimeLayout = "2006-01-02 15:04:05"
 
 func InitVastFlowDb(configFile, dbPass string) error {
-	if atomic.LoadUint32(&initDbDone) == 1 {
+	return defaultEngine.InitDb(configFile, dbPass)
+}
+
+func (e *Engine) InitDb(configFile, dbPass string) error {
+	if atomic.LoadUint32(&e.initDbDone) == 1 {
 		return nil
 	}
 	// Slow-path.
-	initDbLock.Lock()
-	defer initDbLock.Unlock()
-	if initDbDone == 0 {
-		defer atomic.StoreUint32(&initDbDone, 1)
-		return initOnce(configFile, dbPass)
+	e.initDbLock.Lock()
+	defer e.initDbLock.Unlock()
+	if e.initDbDone == 0 {
+		defer atomic.StoreUint32(&e.initDbDone, 1)
+		return e.initOnce(configFile, dbPass)
 	}
 	return nil
 }
 
-func initOnce(configFile, dbPass string) error {
+func (e *Engine) initOnce(configFile, dbPass string) error {
 	basedir := utils.GetBasePath()
 	logs.Debug(basedir)
 	config := conf.LoadFile(filepath.Join(basedir, "conf", configFile))
@@ -55,15 +56,40 @@ func initOnce(configFile, dbPass string) error {
 	// set default database
 	maxIdleConnections := config.GetIntWithDefault("max_idle_connections", 30)
 	maxOpenConnections := config.GetIntWithDefault("max_open_connections", 30)
-	if err := orm.RegisterDataBase("default", "mysql", dsn, maxIdleConnections, maxOpenConnections); err != nil {
+	if err := orm.RegisterDataBase(e.dbAlias, "mysql", dsn, maxIdleConnections, maxOpenConnections); err != nil {
 		logs.Error(err.Error())
 		return err
 	}
 
 	// create table
-	if err := orm.RunSyncdb("default", false, true); err != nil {
+	if err := orm.RunSyncdb(e.dbAlias, false, true); err != nil {
 		logs.Error(err.Error())
 		return err
 	}
 	return nil
 }
+
+// dbTime is dbNow, or utc time of the host if db time can't be read
+func (e *Engine) dbTime() time.Time {
+	now, err := e.dbNow()
+	if err != nil {
+		return time.Now().UTC()
+	}
+	return now
+}
+
+// dbNow is the utc time of database server, liveness is judged by it so clock skew of units doesn't matter
+func (e *Engine) dbNow() (time.Time, error) {
+	var now string
+	o := e.newOrm()
+	if err := o.Raw("SELECT UTC_TIMESTAMP()").QueryRow(&now); err != nil {
+		logs.Error("query db time fail, err:%s", err.Error())
+		return time.Time{}, err
+	}
+	t, err := time.ParseInLocation(dbTimeLayout, now, time.UTC)
+	if err != nil {
+		logs.Error("parse db time(%s) fail, err:%s", now, err.Error())
+		return time.Time{}, err
+	}
+	return t, nil
+}
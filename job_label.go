@@ -0,0 +1,88 @@
+package vastflow
+
+import (
+	"github.com/jack0liu/logs"
+	"sort"
+	"strings"
+)
+
+const (
+	labelSep = ","
+	// pool is scanned in pages for a job this unit can take
+	labelScanSize = 20
+)
+
+// JoinLabels formats labels for JobQueue.Labels, like "region=north-1", "hypervisor=kvm", "has-gpu-driver-tools"
+func JoinLabels(labels ...string) string {
+	return strings.Join(normalizeLabels(labels), labelSep)
+}
+
+// SetUnitLabels sets labels this unit advertises, only jobs requiring a subset of them are fetched from pool
+func SetUnitLabels(labels ...string) error {
+	return defaultEngine.SetUnitLabels(labels...)
+}
+
+func (e *Engine) SetUnitLabels(labels ...string) error {
+	normalized := normalizeLabels(labels)
+	e.labelsMu.Lock()
+	e.labels = normalized
+	e.labelsMu.Unlock()
+	if len(e.unit) == 0 {
+		// saved when heart starts
+		return nil
+	}
+	return e.updateUnitLabels(e.unit, normalized)
+}
+
+// unitLabels gets labels of this unit, fetching reads them while they are set
+func (e *Engine) unitLabels() []string {
+	e.labelsMu.RLock()
+	defer e.labelsMu.RUnlock()
+	return e.labels
+}
+
+func (e *Engine) updateUnitLabels(unit string, labels []string) error {
+	o := e.newOrm()
+	ju := JobUnit{
+		Name:   unit,
+		Labels: strings.Join(labels, labelSep),
+	}
+	if _, err := o.Update(&ju, "labels"); err != nil {
+		logs.Error("update unit(%s) labels fail, err:%s", unit, err.Error())
+		return err
+	}
+	return nil
+}
+
+func labelsSatisfied(required string, have []string) bool {
+	for _, label := range strings.Split(required, labelSep) {
+		label = strings.TrimSpace(label)
+		if len(label) == 0 {
+			continue
+		}
+		i := sort.SearchStrings(have, label)
+		if i >= len(have) || have[i] != label {
+			return false
+		}
+	}
+	return true
+}
+
+func normalizeLabels(labels []string) []string {
+	out := make([]string, 0, len(labels))
+	seen := make(map[string]bool, len(labels))
+	for _, label := range labels {
+		label = strings.TrimSpace(label)
+		if len(label) == 0 || seen[label] {
+			continue
+		}
+		if strings.Contains(label, labelSep) {
+			logs.Warn("label(%s) contains %q, ignored", label, labelSep)
+			continue
+		}
+		seen[label] = true
+		out = append(out, label)
+	}
+	sort.Strings(out)
+	return out
+}
@@ -0,0 +1,53 @@
+package vastflow
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestNormalizeLabels(t *testing.T) {
+	tests := []struct {
+		labels []string
+		want   []string
+	}{
+		{nil, []string{}},
+		{[]string{"region=north-1", "has-gpu"}, []string{"has-gpu", "region=north-1"}},
+		{[]string{" kvm ", "kvm", ""}, []string{"kvm"}},
+		{[]string{"a,b", "c"}, []string{"c"}},
+	}
+	for _, tt := range tests {
+		if got := normalizeLabels(tt.labels); !reflect.DeepEqual(got, tt.want) {
+			t.Fatalf("normalizeLabels(%q) = %q, want %q", tt.labels, got, tt.want)
+		}
+	}
+}
+
+func TestJoinLabels(t *testing.T) {
+	if got := JoinLabels("region=north-1", " kvm", "kvm"); got != "kvm,region=north-1" {
+		t.Fatalf("JoinLabels = %q", got)
+	}
+}
+
+func TestLabelsSatisfied(t *testing.T) {
+	have := normalizeLabels([]string{"region=north-1", "kvm", "has-gpu"})
+	tests := []struct {
+		required string
+		want     bool
+	}{
+		{"", true},
+		{"kvm", true},
+		{"has-gpu,region=north-1", true},
+		{" kvm , ,has-gpu", true},
+		{"kvm,xen", false},
+		{"region=north-2", false},
+		{"zzz", false},
+	}
+	for _, tt := range tests {
+		if got := labelsSatisfied(tt.required, have); got != tt.want {
+			t.Fatalf("labelsSatisfied(%q) = %v, want %v", tt.required, got, tt.want)
+		}
+	}
+	if labelsSatisfied("kvm", nil) {
+		t.Fatalf("unit without labels satisfied a required label")
+	}
+}
@@ -0,0 +1,131 @@
+package vastflow
+
+import (
+	"github.com/astaxie/beego/orm"
+	"github.com/jack0liu/logs"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	housekeepingLeader = "housekeeping"
+	// leadership lasts these heart intervals without renewal
+	leaderTimes = 3
+)
+
+// JobLeader is a lease row, its unit does cluster housekeeping until the lease expires
+type JobLeader struct {
+	Name      string    `orm:"size(64);pk"`
+	Unit      string    `orm:"size(64)"`
+	ExpireAt  time.Time `orm:"null;type(datetime);column(expire_at)"`
+	UpdatedAt time.Time `orm:"null;type(datetime);column(updated_at)"`
+}
+
+func init() {
+	// register model
+	orm.RegisterModel(new(JobLeader))
+}
+
+// IsLeader tells if this unit does housekeeping, like dead unit detection and job reclaiming
+func IsLeader() bool {
+	return defaultEngine.IsLeader()
+}
+
+func (e *Engine) IsLeader() bool {
+	if atomic.LoadInt32(&e.leading) != 1 {
+		return false
+	}
+	// a unit paused past its lease is not leader, even before campaign tells it
+	return time.Now().UnixNano() < atomic.LoadInt64(&e.leaderUntil)
+}
+
+func (e *Engine) leaderTTL() time.Duration {
+	return time.Duration(leaderTimes*e.intervalSec) * time.Second
+}
+
+// campaign takes or renews the leader lease, it succeeds if the lease is ours or expired
+func (e *Engine) campaign(unit string) bool {
+	// the lease is counted from before the db is asked, less one heart interval for safety
+	until := time.Now().Add(e.leaderTTL() - time.Duration(e.intervalSec)*time.Second)
+	now, err := e.dbNow()
+	if err != nil {
+		e.setLeading(unit, false)
+		return false
+	}
+	o := e.newOrm()
+	cond := orm.NewCondition().
+		And("name", housekeepingLeader).
+		AndCond(orm.NewCondition().Or("unit", unit).Or("expire_at__lt", now))
+	num, err := o.QueryTable("job_leader").
+		SetCond(cond).
+		Update(orm.Params{
+			"unit":       unit,
+			"expire_at":  now.Add(e.leaderTTL()),
+			"updated_at": now,
+		})
+	if err != nil {
+		logs.Error("campaign leader fail, err:%s", err.Error())
+		e.setLeading(unit, false)
+		return false
+	}
+	if num == 0 {
+		// nothing changed or no leader row yet
+		leader := JobLeader{Name: housekeepingLeader}
+		if err := o.Read(&leader); err == orm.ErrNoRows {
+			leader.Unit = unit
+			leader.ExpireAt = now.Add(e.leaderTTL())
+			leader.UpdatedAt = now
+			if _, err := o.Insert(&leader); err != nil {
+				logs.Info("campaign leader lost, err:%s", err.Error())
+				e.setLeading(unit, false)
+				return false
+			}
+		} else if err != nil {
+			logs.Error("read leader fail, err:%s", err.Error())
+			e.setLeading(unit, false)
+			return false
+		} else if leader.Unit != unit || !leader.ExpireAt.After(now) {
+			e.setLeading(unit, false)
+			return false
+		}
+	}
+	atomic.StoreInt64(&e.leaderUntil, until.UnixNano())
+	e.setLeading(unit, true)
+	return true
+}
+
+// resign gives up leadership so other units take over without waiting expiration
+func (e *Engine) resign(unit string) {
+	if atomic.LoadInt32(&e.leading) != 1 {
+		return
+	}
+	e.setLeading(unit, false)
+	now, err := e.dbNow()
+	if err != nil {
+		return
+	}
+	o := e.newOrm()
+	if _, err := o.QueryTable("job_leader").
+		Filter("name", housekeepingLeader).
+		Filter("unit", unit).
+		Update(orm.Params{
+			"expire_at":  now,
+			"updated_at": now,
+		}); err != nil {
+		logs.Warn("resign leader fail, err:%s", err.Error())
+	}
+}
+
+func (e *Engine) setLeading(unit string, leader bool) {
+	var v int32
+	if leader {
+		v = 1
+	}
+	if atomic.SwapInt32(&e.leading, v) != v {
+		if leader {
+			logs.Info("unit(%s) becomes leader", unit)
+		} else {
+			logs.Info("unit(%s) is not leader", unit)
+		}
+	}
+}
@@ -3,6 +3,7 @@ package vastflow
 import (
 	"github.com/astaxie/beego/orm"
 	"github.com/jack0liu/logs"
+	"sync/atomic"
 	"time"
 )
 
@@ -16,6 +17,8 @@ type JobUnit struct {
 	Status    string    `orm:"size(64)"`
 	CreateAt  time.Time `orm:"null;type(datetime);column(create_at)"`
 	UpdatedAt time.Time `orm:"null;type(datetime);column(updated_at)"`
+	Epoch     int64     `orm:"default(0)"`
+	Labels    string    `orm:"null;size(512)"` // capabilities of unit, see JoinLabels
 }
 
 func init() {
@@ -24,7 +27,11 @@ func init() {
 }
 
 func SaveUnit(c JobUnit) error {
-	o := orm.NewOrm()
+	return defaultEngine.SaveUnit(c)
+}
+
+func (e *Engine) SaveUnit(c JobUnit) error {
+	o := e.newOrm()
 	_, err := o.Insert(&c)
 	if err != nil {
 		logs.Error("insert error:%s", err.Error())
@@ -34,8 +41,8 @@ func SaveUnit(c JobUnit) error {
 	return nil
 }
 
-func getUnit(unit string) (jobUnit *JobUnit, err error) {
-	o := orm.NewOrm()
+func (e *Engine) getUnit(unit string) (jobUnit *JobUnit, err error) {
+	o := e.newOrm()
 	var ju JobUnit
 	if err := o.QueryTable("job_unit").Filter("name", unit).One(&ju); err != nil {
 		return nil, err
@@ -43,23 +50,73 @@ func getUnit(unit string) (jobUnit *JobUnit, err error) {
 	return &ju, nil
 }
 
-func touchUnit(unit string) error {
-	o := orm.NewOrm()
-	job := JobUnit{
-		Name:      unit,
-		UpdatedAt: time.Now().UTC(),
-		Status:    UnitActive,
+// touchUnit keeps heart of this unit's epoch, it fails with ErrorStaleFence once
+// the unit is registered again by another process
+func (e *Engine) touchUnit(unit string) error {
+	now, err := e.dbNow()
+	if err != nil {
+		return err
 	}
-	if _, err := o.Update(&job, "updated_at", "status"); err != nil {
+	o := e.newOrm()
+	num, err := o.QueryTable("job_unit").
+		Filter("name", unit).
+		Filter("epoch", e.epoch).
+		Update(orm.Params{
+			"updated_at": now,
+			"status":     UnitActive,
+		})
+	if err != nil {
 		logs.Error("update fail,%s", err.Error())
 		return err
 	}
+	if num == 0 {
+		ju, err := e.getUnit(unit)
+		if err != nil {
+			return err
+		}
+		if ju.Epoch != e.epoch {
+			logs.Error("unit(%s) epoch %d is stale, current epoch %d", unit, e.epoch, ju.Epoch)
+			atomic.StoreInt32(&e.fenced, 1)
+			return ErrorStaleFence
+		}
+	}
 	return nil
 }
 
+// registerEpoch starts a new epoch of unit, processes holding an older epoch are fenced
+func (e *Engine) registerEpoch(unit string) (int64, error) {
+	o := e.newOrm()
+	if err := o.Begin(); err != nil {
+		logs.Error("db begin transaction fail")
+		return 0, err
+	}
+	ju := JobUnit{Name: unit}
+	if err := o.ReadForUpdate(&ju); err != nil {
+		logs.Error("read unit(%s) fail, err:%s", unit, err.Error())
+		_ = o.Rollback()
+		return 0, err
+	}
+	ju.Epoch++
+	if _, err := o.Update(&ju, "epoch"); err != nil {
+		logs.Error("update unit(%s) epoch fail, err:%s", unit, err.Error())
+		_ = o.Rollback()
+		return 0, err
+	}
+	if err := o.Commit(); err != nil {
+		logs.Error("db commit transaction fail")
+		return 0, err
+	}
+	logs.Info("unit(%s) epoch %d", unit, ju.Epoch)
+	return ju.Epoch, nil
+}
+
 func UpdateUnitStatus(name, status string, o orm.Ormer) error {
+	return defaultEngine.UpdateUnitStatus(name, status, o)
+}
+
+func (e *Engine) UpdateUnitStatus(name, status string, o orm.Ormer) error {
 	if o == nil {
-		o = orm.NewOrm()
+		o = e.newOrm()
 	}
 	job := JobUnit{
 		Name:   name,
@@ -72,8 +129,8 @@ func UpdateUnitStatus(name, status string, o orm.Ormer) error {
 	return nil
 }
 
-func getOtherUnit(myUnit string) []*JobUnit {
-	o := orm.NewOrm()
+func (e *Engine) getOtherUnit(myUnit string) []*JobUnit {
+	o := e.newOrm()
 	var units []*JobUnit
 	_, err := o.QueryTable("job_unit").
 		Filter("status", UnitActive).
@@ -1,46 +1,55 @@
 package vastflow
 
 import (
+	"context"
 	"errors"
 	"github.com/astaxie/beego/orm"
 	"github.com/jack0liu/logs"
-	"sync"
+	"sync/atomic"
 	"time"
 )
 
 const (
 	defaultHeartInterval = 2
 	displayTimes         = 5
-)
-
-var (
-	heartOnce   = sync.Once{}
-	checkOnce   = sync.Once{}
-	shrinkOnce  = sync.Once{}
-	thisUnit    string
-	intervalSec int
+	// unit heartbeat within these intervals means it's alive, a new unit with same name is replicated
+	defaultReplicateTimes = 2
+	// unit heartbeat older than these check intervals means it's dead
+	defaultDeadTimes = 3
+	// job lease lasts these heart intervals if not set
+	defaultLeaseTimes = 5
+	// expired jobs are left to units adopting them for these heart intervals before requeued
+	adoptGraceTimes = 5
 )
 
 func StartHeart(myUnit string, heartIntervalSec int) error {
+	return defaultEngine.StartHeart(myUnit, heartIntervalSec)
+}
+
+func (e *Engine) StartHeart(myUnit string, heartIntervalSec int) error {
 	if len(myUnit) == 0 {
 		return errors.New("my unit is empty")
 	}
-	thisUnit = myUnit
-	intervalSec = defaultHeartInterval
+	e.unit = myUnit
+	e.intervalSec = defaultHeartInterval
 	if heartIntervalSec > 0 {
-		intervalSec = heartIntervalSec
+		e.intervalSec = heartIntervalSec
 	}
 
+	now, err := e.dbNow()
+	if err != nil {
+		return err
+	}
 	// check unit is valid
-	unit, err := getUnit(myUnit)
+	unit, err := e.getUnit(myUnit)
 	if err == orm.ErrNoRows {
 		newUnit := JobUnit{
 			Name:      myUnit,
 			Status:    UnitActive,
-			CreateAt:  time.Now().UTC(),
-			UpdatedAt: time.Now().UTC(),
+			CreateAt:  now,
+			UpdatedAt: now,
 		}
-		if err := SaveUnit(newUnit); err != nil {
+		if err := e.SaveUnit(newUnit); err != nil {
 			return err
 		}
 		unit = &newUnit
@@ -48,66 +57,232 @@ func StartHeart(myUnit string, heartIntervalSec int) error {
 		logs.Error("get unit fail")
 		return err
 	} else {
-		now := time.Now().UTC()
-		if unit.UpdatedAt.Add(2 * time.Duration(intervalSec) * time.Second).After(now) {
+		if unit.UpdatedAt.Add(time.Duration(e.replicateTimes*e.intervalSec) * time.Second).After(now) {
 			logs.Error("replicate unit(%s)", myUnit)
 			return errors.New("replicate unit")
 		}
-		// check if exist job is running
-		_ = transJobStatusByUnit(myUnit, JobRunning, JobWaiting)
+		// check if exist job is running, the ones keep crashing this unit go to dead letter
+		_ = e.deadLetterJobsByUnit(myUnit, nil)
+		if !e.autoRecover {
+			_ = e.transJobStatusByUnit(myUnit, JobRunning, JobWaiting)
+		}
+	}
+
+	epoch, err := e.registerEpoch(myUnit)
+	if err != nil {
+		return err
+	}
+	e.epoch = epoch
+	atomic.StoreInt32(&e.fenced, 0)
+	if err := e.updateUnitLabels(myUnit, e.unitLabels()); err != nil {
+		return err
 	}
 
-	if err := touchUnit(myUnit); err != nil {
+	if err := e.touchUnit(myUnit); err != nil {
 		logs.Error("keep heart fail")
 		return err
 	}
+	e.campaign(myUnit)
 
-	go heartOnce.Do(heart)
-	go checkOnce.Do(checkOtherIfDead)
-	go shrinkOnce.Do(checkShrink)
+	e.heartOnce.Do(func() { e.goHeart(e.heart) })
+	e.checkOnce.Do(func() { e.goHeart(e.checkOtherIfDead) })
+	e.shrinkOnce.Do(func() { e.goHeart(e.checkShrink) })
+	if e.autoRecover {
+		// recover while heart keeps leases of the unit alive
+		go func() {
+			e.reportRecovery(e.RecoverJobs(myUnit))
+		}()
+	}
 	return nil
 }
 
-func heart() {
-	t := time.NewTicker(time.Duration(intervalSec) * time.Second)
+func (e *Engine) goHeart(f func()) {
+	e.heartWg.Add(1)
+	go func() {
+		defer e.heartWg.Done()
+		f()
+	}()
+}
+
+// Shutdown stops fetching jobs and waits running rivers stop at a safe point, then hands
+// jobs of this unit back to the pool, stops background goroutines and marks the unit dead.
+// Rivers not stopped before ctx is done are left to other units to resume.
+func Shutdown(ctx context.Context) error {
+	return defaultEngine.Shutdown(ctx)
+}
+
+func (e *Engine) Shutdown(ctx context.Context) error {
+	if !atomic.CompareAndSwapInt32(&e.shuttingDown, 0, 1) {
+		return ErrorShutdown
+	}
+	logs.Info("unit(%s) shutting down", e.unit)
+	close(e.stopping)
+
+	err := e.waitSafePoint(ctx)
+	if err != nil {
+		logs.Warn("%d streams not stopped, err:%s", atomic.LoadInt64(&e.runningCount), err.Error())
+	}
+
+	close(e.heartStop)
+	e.heartWg.Wait()
+	if len(e.unit) == 0 || e.isFenced() {
+		// jobs and unit belong to the new epoch
+		return err
+	}
+	e.resign(e.unit)
+	if rErr := e.releaseUnitJobs(e.unit); rErr != nil && err == nil {
+		err = rErr
+	}
+	if uErr := e.UpdateUnitStatus(e.unit, UnitDead, nil); uErr != nil && err == nil {
+		err = uErr
+	}
+	logs.Info("unit(%s) shutdown", e.unit)
+	return err
+}
+
+func (e *Engine) isFenced() bool {
+	return atomic.LoadInt32(&e.fenced) == 1
+}
+
+func (e *Engine) isShuttingDown() bool {
+	return atomic.LoadInt32(&e.shuttingDown) == 1
+}
+
+func (e *Engine) enterRun() {
+	atomic.AddInt64(&e.runningCount, 1)
+}
+
+func (e *Engine) leaveRun() {
+	atomic.AddInt64(&e.runningCount, -1)
+}
+
+// goRun counts the stream before the goroutine starts, so shutdown never sees a gap
+func (e *Engine) goRun(stream Stream, headwaters *Headwaters, syncNext bool) {
+	e.enterRun()
+	go func() {
+		defer e.leaveRun()
+		_ = stream.Run(headwaters, riverFlowOf(stream), syncNext)
+	}()
+}
+
+func (e *Engine) waitSafePoint(ctx context.Context) error {
+	t := time.NewTicker(100 * time.Millisecond)
+	defer t.Stop()
+	for atomic.LoadInt64(&e.runningCount) > 0 {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-t.C:
+		}
+	}
+	return nil
+}
+
+// SetLivenessTimes sets multipliers of heart interval judging unit liveness, replicate times for
+// refusing a unit started with a living name, dead times for declaring other units dead
+func SetLivenessTimes(replicate, dead int) {
+	defaultEngine.SetLivenessTimes(replicate, dead)
+}
+
+func (e *Engine) SetLivenessTimes(replicate, dead int) {
+	if replicate > 0 {
+		e.replicateTimes = replicate
+	}
+	if dead > 0 {
+		e.deadTimes = dead
+	}
+}
+
+// SetJobLeaseSec sets how long a fetched job is owned without renewal
+func SetJobLeaseSec(sec int) {
+	defaultEngine.SetJobLeaseSec(sec)
+}
+
+func (e *Engine) SetJobLeaseSec(sec int) {
+	e.leaseSec = sec
+}
+
+func (e *Engine) leaseDuration() time.Duration {
+	if e.leaseSec > 0 {
+		return time.Duration(e.leaseSec) * time.Second
+	}
+	interval := e.intervalSec
+	if interval <= 0 {
+		interval = defaultHeartInterval
+	}
+	return time.Duration(defaultLeaseTimes*interval) * time.Second
+}
+
+func (e *Engine) heart() {
+	t := time.NewTicker(time.Duration(e.intervalSec) * time.Second)
+	defer t.Stop()
 	displayIntervalCount := 0
 	for {
 		select {
+		case <-e.heartStop:
+			return
 		case <-t.C:
-			if err := touchUnit(thisUnit); err != nil {
+			if err := e.touchUnit(e.unit); err != nil {
 				logs.Error("keep heart fail")
 			}
+			// keeps the reading of stats fresh while the window is neither full nor extended
+			e.wnd.Lock()
+			e.wnd.calc()
+			e.wnd.Unlock()
+			if !e.isFenced() {
+				e.renewJobLeases(e.unit)
+				e.campaign(e.unit)
+				if e.autoRecover && !e.isShuttingDown() {
+					e.reportRecovery(e.adoptExpiredJobs(e.unit))
+				}
+			} else {
+				e.setLeading(e.unit, false)
+			}
 			displayIntervalCount++
 			if displayIntervalCount == displayTimes {
 				displayIntervalCount = 0
-				flowWnd.Print()
+				e.wnd.Print()
 			}
 		}
 	}
 }
 
-func checkOtherIfDead() {
-	checkInterval := 5 * intervalSec
+func (e *Engine) checkOtherIfDead() {
+	checkInterval := 5 * e.intervalSec
 	t := time.NewTicker(time.Duration(checkInterval) * time.Second)
+	defer t.Stop()
 	for {
 		select {
+		case <-e.heartStop:
+			return
 		case <-t.C:
-			units := getOtherUnit(thisUnit)
-			now := time.Now().UTC()
+			if !e.IsLeader() {
+				continue
+			}
+			_ = e.reclaimExpiredJobs()
+			now, err := e.dbNow()
+			if err != nil {
+				continue
+			}
+			units := e.getOtherUnit(e.unit)
 			for _, u := range units {
-				if now.After(u.UpdatedAt.Add(3 * time.Duration(checkInterval) * time.Second)) {
+				if !e.IsLeader() {
+					// lease passed while checking
+					break
+				}
+				if now.After(u.UpdatedAt.Add(time.Duration(e.deadTimes*checkInterval) * time.Second)) {
 					logs.Info("unit(%s) dead", u.Name)
-					o := orm.NewOrm()
+					o := e.newOrm()
 					if err := o.Begin(); err != nil {
 						logs.Warn("begin fail")
 						continue
 					}
-					if err := UpdateUnitStatus(u.Name, UnitDead, o); err != nil {
+					if err := e.UpdateUnitStatus(u.Name, UnitDead, o); err != nil {
 						logs.Error("update unit(%s) dead fail, err:%s", u.Name, err.Error())
 						_ = o.Rollback()
 						continue
 					}
-					if err := UnSetJobUnit(u.Name, o); err != nil {
+					if err := e.UnSetJobUnit(u.Name, o); err != nil {
 						logs.Error("unset unit(%s) fail, err:%s", u.Name, err.Error())
 						_ = o.Rollback()
 						continue
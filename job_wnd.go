@@ -1,6 +1,8 @@
 package vastflow
 
 import (
+	"errors"
+	"fmt"
 	"github.com/jack0liu/logs"
 	"io/ioutil"
 	"math"
@@ -20,15 +22,13 @@ const (
 	defaultExtendLen   = 2
 )
 
-var flowWnd = &FlowWnd{
-	Capacity: DefaultWndCapacity,
-	CurSize:  0,
-}
-
-var sys = &SysInfo{}
-
 type SysInfo struct {
-	CPU float64
+	CPU      float64 // percent of one cpu
+	CPUCores float64 // cpu the process may use
+	CPUUtil  float64 // CPU relative to CPUCores, in [0, 1]
+	MemUsage uint64
+	MemLimit uint64  // zero means no memory limit
+	MemUtil  float64 // MemUsage relative to MemLimit, in [0, 1]
 }
 
 type stat struct {
@@ -48,13 +48,54 @@ type FlowWnd struct {
 
 	usedCpuNum int
 	markRate   float64
+	cgroup     *cgroupLimit
 
 	clk float64
 
 	history stat
+	sys     SysInfo
+
+	slowExpandCount int
+
+	pools      map[string]*wndPool
+	slots      map[string]*wndSlot // by request id
+	sharedUsed int64
+
+	// counted since start
+	extendEvents int64
+	shrinkEvents int64
+	claimed      int64
+	rejected     int64
+}
+
+// WndStats is a snapshot of the flow window and job fetching
+type WndStats struct {
+	Capacity     int64
+	Extended     int64
+	CurSize      int64
+	Sys          SysInfo // the last reading, taken every heart interval
+	ExtendEvents int64
+	ShrinkEvents int64
+	Claimed      int64 // jobs fetched
+	Rejected     int64 // fetches refused by admission
+	Pools        map[string]PoolStats
+}
+
+func newFlowWnd() *FlowWnd {
+	return &FlowWnd{
+		Capacity: DefaultWndCapacity,
+		CurSize:  0,
+		pools:    make(map[string]*wndPool),
+		slots:    make(map[string]*wndSlot),
+	}
 }
 
 func InitWnd(capacity int64, cpuNum int, markRate float64) {
+	defaultEngine.InitWnd(capacity, cpuNum, markRate)
+}
+
+func (e *Engine) InitWnd(capacity int64, cpuNum int, markRate float64) {
+	flowWnd := e.wnd
 	flowWnd.Capacity = capacity
 	flowWnd.usedCpuNum = cpuNum
 	flowWnd.markRate = markRate
@@ -65,21 +106,72 @@ func InitWnd(capacity int64, cpuNum int, markRate float64) {
 		if err == nil {
 			flowWnd.clk = parseFloat(formatStdOut(clkTckStdout, 0)[0])
 		}
+		flowWnd.cgroup = detectCgroup()
 	}
+	flowWnd.sys.CPUCores = flowWnd.cpuCores()
+	logs.Info("flow window uses %f cpu cores", flowWnd.sys.CPUCores)
+
+}
 
+func GetWndStats() WndStats {
+	return defaultEngine.GetWndStats()
+}
+
+func (e *Engine) GetWndStats() WndStats {
+	e.wnd.RLock()
+	defer e.wnd.RUnlock()
+	return WndStats{
+		Capacity:     e.wnd.Capacity,
+		Extended:     e.wnd.extended,
+		CurSize:      e.wnd.CurSize,
+		Sys:          e.wnd.sys,
+		ExtendEvents: e.wnd.extendEvents,
+		ShrinkEvents: e.wnd.shrinkEvents,
+		Claimed:      e.wnd.claimed,
+		Rejected:     e.wnd.rejected,
+		Pools:        e.wnd.poolStats(),
+	}
+}
+
+// SetWndCapacity changes capacity at runtime, running jobs over it are not affected.
+// it can't be less than slots reserved by pools, see SetWndPool
+func SetWndCapacity(capacity int64) error {
+	return defaultEngine.SetWndCapacity(capacity)
+}
+
+func (e *Engine) SetWndCapacity(capacity int64) error {
+	if capacity <= 0 {
+		return errors.New("capacity must be positive")
+	}
+	e.wnd.Lock()
+	defer e.wnd.Unlock()
+	if reserved := e.wnd.reserved(); capacity < reserved {
+		return fmt.Errorf("capacity %d is less than %d slots reserved by pools", capacity, reserved)
+	}
+	logs.Info("wnd capacity %d -> %d", e.wnd.Capacity, capacity)
+	e.wnd.Capacity = capacity
+	return nil
 }
 
-func checkShrink() {
+func (e *Engine) checkShrink() {
+	flowWnd := e.wnd
 	t := time.NewTicker(10 * time.Second)
+	defer t.Stop()
 	continueCount := 0
 	for {
 		select {
+		case <-e.heartStop:
+			return
 		case <-t.C:
 			if flowWnd.extended <= 0 {
 				break
 			}
 			flowWnd.Lock()
-			if flowWnd.CurSize+defaultShrinkLen < flowWnd.Capacity+flowWnd.extended {
+			if flowWnd.IsOverMark() {
+				// extended jobs take cpu or memory over the limit
+				flowWnd.Shrink(defaultShrinkLen)
+				continueCount = 0
+			} else if flowWnd.CurSize+defaultShrinkLen < flowWnd.Capacity+flowWnd.extended {
 				continueCount++
 			} else {
 				continueCount = 0
@@ -103,10 +195,12 @@ func (fw *FlowWnd) checkShrink() bool {
 func (fw *FlowWnd) Extend(num int64) {
 	logs.Info("wnd extended")
 	fw.extended = fw.extended + num
+	fw.extendEvents++
 }
 
 func (fw *FlowWnd) Shrink(num int64) {
 	logs.Info("wnd shrink")
+	fw.shrinkEvents++
 	fw.extended = fw.extended - num
 	if fw.extended < 0 {
 		fw.extended = 0
@@ -128,12 +222,68 @@ func (fw *FlowWnd) Remains() int64 {
 	return fw.Capacity + fw.extended - fw.CurSize
 }
 
+// Admit makes FlowWnd the default admission, the window extends when it's full
+// but cpu keeps below the mark for a while
+func (fw *FlowWnd) Admit(running int64) error {
+	if fw.Capacity+fw.extended-running <= 0 {
+		errStr := fmt.Sprintf("not have enough wnd, curSize:%d, total capacity:%d",
+			running, fw.Capacity+fw.extended)
+		logs.Info(errStr)
+		if fw.IsBelowMark() {
+			fw.slowExpandCount++
+			if fw.slowExpandCount >= maxContinueCount {
+				fw.Extend(defaultExtendLen)
+			}
+		} else {
+			logs.Info("over mark, clean count")
+			fw.slowExpandCount = 0
+		}
+		return errors.New(errStr)
+	}
+	fw.slowExpandCount = 0
+	return nil
+}
+
+// IsBelowMark tells if both cpu and memory utilization are below the mark rate
 func (fw *FlowWnd) IsBelowMark() bool {
 	info := fw.calc()
-	if info.CPU < fw.markRate*100*float64(fw.usedCpuNum) {
-		return true
+	if info.CPUUtil >= fw.markRate {
+		return false
 	}
-	return false
+	if info.MemLimit > 0 && info.MemUtil >= fw.markRate {
+		return false
+	}
+	return true
+}
+
+// IsOverMark tells if cpu or memory utilization exceeds the mark rate
+func (fw *FlowWnd) IsOverMark() bool {
+	if fw.markRate <= 0 {
+		return false
+	}
+	info := fw.calc()
+	return info.CPUUtil > fw.markRate || (info.MemLimit > 0 && info.MemUtil > fw.markRate)
+}
+
+// cpuCores is the cgroup quota, limited further by cpu num set in InitWnd
+func (fw *FlowWnd) cpuCores() float64 {
+	cores := float64(runtime.NumCPU())
+	if fw.cgroup != nil && fw.cgroup.cpuCores > 0 && fw.cgroup.cpuCores < cores {
+		cores = fw.cgroup.cpuCores
+	}
+	if fw.usedCpuNum > 0 && float64(fw.usedCpuNum) < cores {
+		cores = float64(fw.usedCpuNum)
+	}
+	return cores
+}
+
+func (fw *FlowWnd) calcMem() {
+	if fw.cgroup == nil || fw.cgroup.memBytes == 0 {
+		return
+	}
+	fw.sys.MemLimit = fw.cgroup.memBytes
+	fw.sys.MemUsage = fw.cgroup.memUsage()
+	fw.sys.MemUtil = float64(fw.sys.MemUsage) / float64(fw.sys.MemLimit)
 }
 
 func (fw *FlowWnd) Print() {
@@ -143,20 +293,20 @@ func (fw *FlowWnd) Print() {
 func (fw *FlowWnd) calc() *SysInfo {
 	if runtime.GOOS != "linux" {
 		logs.Debug("not linux, return 0.0")
-		return sys
+		return &fw.sys
 	}
 
 	uptimeFileBytes, err := ioutil.ReadFile(path.Join("/proc", "uptime"))
 	if err != nil {
 		logs.Error("get uptime fail")
-		return sys
+		return &fw.sys
 	}
 	uptime := parseFloat(strings.Split(string(uptimeFileBytes), " ")[0])
 	procStatFileBytes, _ := ioutil.ReadFile(path.Join("/proc", strconv.Itoa(os.Getpid()), "stat"))
 	splitAfter := strings.SplitAfter(string(procStatFileBytes), ")")
 	if len(splitAfter) == 0 || len(splitAfter) == 1 {
 		logs.Error("get stat fail")
-		return sys
+		return &fw.sys
 	}
 	infos := strings.Split(splitAfter[1], " ")
 	st := stat{
@@ -188,9 +338,13 @@ func (fw *FlowWnd) calc() *SysInfo {
 	if seconds == 0 {
 		seconds = 1
 	}
-	sys.CPU = (total / seconds) * 100
-	logs.Debug("cpu: %f", sys.CPU)
-	return sys
+	fw.sys.CPU = (total / seconds) * 100
+	if fw.sys.CPUCores > 0 {
+		fw.sys.CPUUtil = fw.sys.CPU / (100 * fw.sys.CPUCores)
+	}
+	fw.calcMem()
+	logs.Debug("cpu: %f, cpu util: %f, mem util: %f", fw.sys.CPU, fw.sys.CPUUtil, fw.sys.MemUtil)
+	return &fw.sys
 }
 
 func parseFloat(val string) float64 {
@@ -0,0 +1,463 @@
+package vastflow
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/jack0liu/logs"
+	"reflect"
+	"sort"
+)
+
+const (
+	mapItemKey  = "vast_flow_map_item"
+	mapIndexKey = "vast_flow_map_index"
+)
+
+// Mapper fans out a river over a list read from headwaters at run time. Expand draws the
+// sub-chain of one item, whose streams must be registered. Items are expanded once and
+// saved, a reloaded andes resumes the same items.
+type Mapper interface {
+	Items(headwaters *Headwaters) []interface{}
+	Expand(index int, item interface{}) Stream
+}
+
+// Collector is optionally implemented by a Mapper to gather results of items into headwaters.
+// By default contexts of items are put in a list under MapResultKey, leaving out keys keeping
+// the value the river's headwaters had before items ran.
+type Collector interface {
+	Collect(headwaters *Headwaters, items []*Headwaters) error
+}
+
+type MapStream interface {
+	addItem(index int, river Stream)
+	getItems() []Stream
+	setExpanded(expanded bool)
+}
+
+// MapRiver is embedded by a type implementing Mapper, every item runs with its own
+// headwaters copied from the river's, see MapItem and MapIndex
+type MapRiver struct {
+	attr RiverAttr
+
+	expanded bool
+	indexes  []int
+	items    []Stream
+	waters   []*Headwaters // headwaters of items
+	option   StreamOption
+
+	id      string
+	errStr  string // failed error str
+	down    Stream
+	state   streamState
+	color   string
+	waterId string // used for restore
+}
+
+// MapItem is the item of headwaters running in a map river. Items are saved as json, after
+// restore it's decoded like map[string]interface{} or float64, see DecodeMapItem for the type
+// Items returned.
+func MapItem(headwaters *Headwaters) interface{} {
+	return headwaters.Get(mapItemKey)
+}
+
+// DecodeMapItem decodes the item of headwaters into out, before and after restore alike
+func DecodeMapItem(headwaters *Headwaters, out interface{}) error {
+	b, err := json.Marshal(MapItem(headwaters))
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(b, out)
+}
+
+// MapIndex is the index of item of headwaters running in a map river
+func MapIndex(headwaters *Headwaters) int {
+	return headwaters.GetInt(mapIndexKey)
+}
+
+// MapResultKey is the headwaters key of item contexts collected by default
+func MapResultKey(mapper Mapper) string {
+	return "map_results." + reflect.TypeOf(mapper).Elem().Name()
+}
+
+func (mr *MapRiver) setFail(errStr string, headwaters *Headwaters) error {
+	mr.state = stateFail
+	mr.errStr = errStr
+	if err := setFlowEnd(headwaters, mr.id, stateFail.String(), errStr); err != nil {
+		logs.Error("update state fail, err:%s", err.Error())
+		return err
+	}
+	if !mr.attr.isInner {
+		headwaters.Cancel(errors.New(errStr))
+		runFailure(headwaters)
+	}
+	return nil
+}
+
+func (mr *MapRiver) setSuccess(headwaters *Headwaters) error {
+	mr.state = stateSuccess
+	if err := setFlowEnd(headwaters, mr.id, stateSuccess.String(), ""); err != nil {
+		logs.Error("update state fail, err:%s", err.Error())
+		return err
+	}
+	return nil
+}
+
+func (mr *MapRiver) setRunning(headwaters *Headwaters) error {
+	mr.state = stateRunning
+	if err := setFlowStart(headwaters, mr.id, stateRunning.String()); err != nil {
+		logs.Error("update state fail, err:%s", err.Error())
+		return err
+	}
+	return nil
+}
+
+func (mr *MapRiver) updateWater(headwaters *Headwaters) error {
+	if err := updateHeadwaters(headwaters); err != nil {
+		logs.Error("update water fail, err:%s", err.Error())
+		return err
+	}
+	return nil
+}
+
+func (mr *MapRiver) Run(headwaters *Headwaters, flow RiverFlow, syncNext bool) (err error) {
+	headwaters.eng().enterRun()
+	defer headwaters.eng().leaveRun()
+	defer func() {
+		if e := recover(); e != nil {
+			logs.Error("%v", e)
+			PrintStack()
+			_ = mr.setFail("got an panic", headwaters)
+			err = errors.New("got an panic")
+		}
+	}()
+	mr.runInit(flow)
+	switch mr.state {
+	case stateInit:
+		if err = mr.setRunning(headwaters); err != nil {
+			return err
+		}
+		fallthrough
+	case stateRunning:
+		if err = mr.runFlow(headwaters, flow); err != nil {
+			if err == ErrorShutdown {
+				return err
+			}
+			if err2 := mr.setFail(err.Error(), headwaters); err2 != nil {
+				logs.Error("map set fail failed")
+			}
+			return err
+		}
+		if err = mr.updateWater(headwaters); err != nil {
+			return err
+		}
+		if err = mr.setSuccess(headwaters); err != nil {
+			return err
+		}
+		fallthrough
+	case stateSuccess:
+		return mr.runNext(headwaters, syncNext)
+	case stateFail:
+		logs.Error("flow has been failed")
+		err = errors.New("flow has been failed")
+		headwaters.Cancel(err)
+		if !mr.attr.isInner {
+			// resume failure interrupted before atlantic
+			runFailure(headwaters)
+		}
+		return err
+
+	default:
+		logs.Error("invalid map river state:%s", mr.state.String())
+		return errors.New("invalid map river state:" + mr.state.String())
+	}
+}
+
+func (mr *MapRiver) runFlow(headwaters *Headwaters, flow RiverFlow) error {
+	select {
+	case <-headwaters.basinFinish():
+		return ErrorCanceled
+	case <-headwaters.Done():
+		return ErrorCanceled
+	default:
+	}
+	mapper, ok := flow.(Mapper)
+	if !ok {
+		return errors.New("map river not implement Mapper")
+	}
+	if !mr.expanded {
+		if err := mr.expand(headwaters, mapper); err != nil {
+			return err
+		}
+	} else if err := mr.restoreWaters(headwaters); err != nil {
+		return err
+	}
+
+	// keys kept as before items run are not results
+	before := headwaters.snapshot()
+	outcomes, err := fanOut(headwaters, mr.items, mr.option, func(scope *Headwaters, i int) error {
+		return mr.runItem(scope, i)
+	})
+	for i := range outcomes {
+		outcomes[i].Index = mr.indexes[i]
+	}
+	headwaters.Put(BranchOutcomeKey(mr), outcomes)
+
+	if hwErr := headwaters.Err(); hwErr != nil {
+		return hwErr
+	}
+	if err != nil {
+		return err
+	}
+	return mr.collect(headwaters, mapper, before)
+}
+
+func (mr *MapRiver) runItem(scope *Headwaters, i int) error {
+	item, hw := mr.items[i], mr.waters[i]
+	// the item is canceled with the scope of the river
+	stop := make(chan struct{})
+	defer close(stop)
+	go func() {
+		select {
+		case <-stop:
+		case <-scope.Done():
+			hw.Cancel(scope.Err())
+		}
+	}()
+	err := item.Run(hw, riverFlowOf(item), true)
+	if err != nil && err != ErrorShutdown && err != ErrorCanceled {
+		return fmt.Errorf("map item %d failed, %s", mr.indexes[i], err.Error())
+	}
+	return err
+}
+
+// expand draws sub-chains of items and saves them with their headwaters at once
+func (mr *MapRiver) expand(headwaters *Headwaters, mapper Mapper) error {
+	items := mapper.Items(headwaters)
+	streams := make([]Stream, 0, len(items))
+	waters := make([]*Headwaters, 0, len(items))
+	for i, item := range items {
+		st := mapper.Expand(i, item)
+		if st == nil || riverFlowOf(st) == nil {
+			return fmt.Errorf("map item %d expands no river", i)
+		}
+		hw := headwaters.copy4Basin()
+		hw.Put(mapItemKey, item)
+		hw.Put(mapIndexKey, i)
+		streams = append(streams, st)
+		waters = append(waters, hw)
+	}
+	if err := saveExpand(headwaters, mr.id, streams, waters); err != nil {
+		logs.Error("[%s]save map items fail, err:%s", headwaters.RequestId, err.Error())
+		return err
+	}
+	for i, st := range streams {
+		mr.addItem(i, st)
+	}
+	mr.waters = waters
+	mr.expanded = true
+	logs.Info("[%s][%s]map river expanded %d items", headwaters.RequestId, mr.color, len(items))
+	return nil
+}
+
+// restoreWaters loads headwaters of items expanded before restart
+func (mr *MapRiver) restoreWaters(headwaters *Headwaters) error {
+	if len(mr.waters) == len(mr.items) {
+		return nil
+	}
+	e := headwaters.eng()
+	waters := make([]*Headwaters, 0, len(mr.items))
+	for i, item := range mr.items {
+		fw := e.queryWaterById(item.getWaterId())
+		if fw == nil {
+			return fmt.Errorf("missed water of map item %d", mr.indexes[i])
+		}
+		hw := e.fromPersistWater(fw.Headwaters)
+		if hw == nil {
+			return fmt.Errorf("invalid water of map item %d", mr.indexes[i])
+		}
+		// replace global and basin context
+		hw.atlantic = headwaters.atlantic
+		hw.setJob(headwaters.jobRequestId(), headwaters.getFence())
+		hw.first = headwaters.first
+		hw.basinDone = headwaters.basinDone
+		hw.basinMu = headwaters.basinMu
+		hw.basinErr = headwaters.basinErr
+		waters = append(waters, hw)
+	}
+	mr.waters = waters
+	return nil
+}
+
+func (mr *MapRiver) collect(headwaters *Headwaters, mapper Mapper, before map[string]interface{}) error {
+	if collector, ok := mapper.(Collector); ok {
+		return collector.Collect(headwaters, mr.waters)
+	}
+	results := make([]map[string]interface{}, 0, len(mr.waters))
+	for _, hw := range mr.waters {
+		result := make(map[string]interface{})
+		for k, v := range hw.snapshot() {
+			if k == mapItemKey || k == mapIndexKey {
+				continue
+			}
+			if pv, ok := before[k]; ok && reflect.DeepEqual(pv, v) {
+				// copied from the river's headwaters
+				continue
+			}
+			result[k] = v
+		}
+		results = append(results, result)
+	}
+	headwaters.Put(MapResultKey(mapper), results)
+	return nil
+}
+
+func (mr *MapRiver) addItem(index int, river Stream) {
+	river.setColor(mr.color)
+	river.setInner()
+	for r := river.next(); r != nil; r = r.next() {
+		r.setColor(mr.color)
+		r.setInner()
+	}
+	pos := sort.SearchInts(mr.indexes, index)
+	mr.indexes = append(mr.indexes, 0)
+	copy(mr.indexes[pos+1:], mr.indexes[pos:])
+	mr.indexes[pos] = index
+	mr.items = append(mr.items, nil)
+	copy(mr.items[pos+1:], mr.items[pos:])
+	mr.items[pos] = river
+}
+
+// SetMaxConcurrency limits items running at a time, 0 means no limit
+func (mr *MapRiver) SetMaxConcurrency(n int) *MapRiver {
+	mr.option.MaxConcurrency = n
+	return mr
+}
+
+// SetFailPolicy sets how failed items are handled, FailFast by default
+func (mr *MapRiver) SetFailPolicy(policy FailPolicy) *MapRiver {
+	mr.option.Policy = policy
+	return mr
+}
+
+// SetQuorum sets Quorum policy, succeeds if at least n items succeed, n is in [1, items]
+func (mr *MapRiver) SetQuorum(n int) *MapRiver {
+	if n <= 0 {
+		panic("quorum must be positive")
+	}
+	mr.option.Policy = Quorum
+	mr.option.Quorum = n
+	return mr
+}
+
+// SetOutcomeKey sets the headwaters key of item outcomes, see BranchOutcomes
+func (mr *MapRiver) SetOutcomeKey(key string) *MapRiver {
+	mr.option.OutcomeKey = key
+	return mr
+}
+
+func (mr *MapRiver) getOption() StreamOption {
+	return mr.option
+}
+
+func (mr *MapRiver) setOption(option StreamOption) {
+	mr.option = option
+}
+
+func (mr *MapRiver) getItems() []Stream {
+	return mr.items
+}
+
+func (mr *MapRiver) setExpanded(expanded bool) {
+	mr.expanded = expanded
+}
+
+func (mr *MapRiver) runInit(flow RiverFlow) {
+	flow.Update(&mr.attr)
+}
+
+func (mr *MapRiver) runNext(headwaters *Headwaters, syncNext bool) error {
+	// do next
+	if mr.next() != nil {
+		if headwaters.eng().isShuttingDown() {
+			logs.Info("[%s][%s]unit is shutting down, stop before next", headwaters.RequestId, mr.color)
+			return ErrorShutdown
+		}
+		if syncNext {
+			return mr.next().Run(headwaters, riverFlowOf(mr.next()), syncNext)
+		} else {
+			headwaters.eng().goRun(mr.next(), headwaters, syncNext)
+		}
+	} else {
+		if !mr.attr.isInner {
+			headwaters.atlantic.runSuccess(headwaters, atlanticFlowOf(headwaters.atlantic))
+		}
+	}
+	return nil
+}
+
+func (mr *MapRiver) Update(attr *RiverAttr) {
+}
+
+func (mr *MapRiver) Flow(headwaters *Headwaters) (errCause string, err error) {
+	return "", nil
+}
+
+func (mr *MapRiver) Cycle(headwaters *Headwaters) (errCause string, err error) {
+	return "", nil
+}
+
+func (mr *MapRiver) next() Stream {
+	return mr.down
+}
+
+func (mr *MapRiver) SetDownStream(down Stream) {
+	mr.down = down
+}
+
+func (mr *MapRiver) setInner() {
+	mr.attr.isInner = true
+}
+
+func (mr *MapRiver) setId(id string) {
+	mr.id = id
+}
+
+func (mr *MapRiver) getId() string {
+	return mr.id
+}
+
+func (mr *MapRiver) setColor(color string) {
+	mr.color = color
+	for _, river := range mr.items {
+		river.setColor(color)
+		for r := river.next(); r != nil; r = r.next() {
+			r.setColor(color)
+		}
+	}
+}
+
+// used for load
+func (mr *MapRiver) colorCurrent(color string) {
+	mr.color = color
+}
+
+func (mr *MapRiver) GetColor() string {
+	return mr.color
+}
+
+func (mr *MapRiver) setState(state streamState) {
+	mr.state = state
+}
+
+func (mr *MapRiver) getState() streamState {
+	return mr.state
+}
+
+func (mr *MapRiver) setWaterId(waterId string) {
+	mr.waterId = waterId
+}
+
+func (mr *MapRiver) getWaterId() string {
+	return mr.waterId
+}
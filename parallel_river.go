@@ -3,7 +3,6 @@ package vastflow
 import (
 	"errors"
 	"github.com/jack0liu/logs"
-	"sync"
 )
 
 type ParallelStream interface {
@@ -14,8 +13,8 @@ type ParallelStream interface {
 type ParallelRiver struct {
 	attr RiverAttr
 
-	wg     sync.WaitGroup
 	rivers []Stream
+	option StreamOption
 
 	id      string
 	errStr  string // failed error str
@@ -32,29 +31,29 @@ func init() {
 func (pa *ParallelRiver) setFail(errStr string, headwaters *Headwaters) error {
 	pa.state = stateFail
 	pa.errStr = errStr
-	if err := setFlowEnd(pa.id, stateFail.String(), errStr); err != nil {
+	if err := setFlowEnd(headwaters, pa.id, stateFail.String(), errStr); err != nil {
 		logs.Error("update state fail, err:%s", err.Error())
 		return err
 	}
 	if !pa.attr.isInner {
 		headwaters.Cancel(errors.New(errStr))
-		headwaters.atlantic.runFail(headwaters, headwaters.atlantic.(AtlanticFlow))
+		runFailure(headwaters)
 	}
 	return nil
 }
 
-func (pa *ParallelRiver) setSuccess() error {
+func (pa *ParallelRiver) setSuccess(headwaters *Headwaters) error {
 	pa.state = stateSuccess
-	if err := setFlowEnd(pa.id, stateSuccess.String(), ""); err != nil {
+	if err := setFlowEnd(headwaters, pa.id, stateSuccess.String(), ""); err != nil {
 		logs.Error("update state fail, err:%s", err.Error())
 		return err
 	}
 	return nil
 }
 
-func (pa *ParallelRiver) setRunning() error {
+func (pa *ParallelRiver) setRunning(headwaters *Headwaters) error {
 	pa.state = stateRunning
-	if err := setFlowStart(pa.id, stateRunning.String()); err != nil {
+	if err := setFlowStart(headwaters, pa.id, stateRunning.String()); err != nil {
 		logs.Error("update state fail, err:%s", err.Error())
 		return err
 	}
@@ -70,6 +69,8 @@ func (pa *ParallelRiver) updateWater(headwaters *Headwaters) error {
 }
 
 func (pa *ParallelRiver) Run(headwaters *Headwaters, flow RiverFlow, syncNext bool) (err error) {
+	headwaters.eng().enterRun()
+	defer headwaters.eng().leaveRun()
 	defer func() {
 		if e := recover(); e != nil {
 			logs.Error("%v", e)
@@ -81,13 +82,16 @@ func (pa *ParallelRiver) Run(headwaters *Headwaters, flow RiverFlow, syncNext bo
 	pa.runInit(flow)
 	switch pa.state {
 	case stateInit:
-		if err = pa.setRunning(); err != nil {
+		if err = pa.setRunning(headwaters); err != nil {
 			return err
 		}
 		fallthrough
 	case stateRunning:
 		if err = pa.runFlow(headwaters, flow); err != nil {
-			if err2 := pa.setFail("", headwaters); err2 != nil {
+			if err == ErrorShutdown {
+				return err
+			}
+			if err2 := pa.setFail(err.Error(), headwaters); err2 != nil {
 				logs.Error("parallel set fail failed")
 			}
 			return err
@@ -97,7 +101,7 @@ func (pa *ParallelRiver) Run(headwaters *Headwaters, flow RiverFlow, syncNext bo
 				return err
 			}
 		}
-		if err := pa.setSuccess(); err != nil {
+		if err := pa.setSuccess(headwaters); err != nil {
 			return err
 		}
 		fallthrough
@@ -107,6 +111,10 @@ func (pa *ParallelRiver) Run(headwaters *Headwaters, flow RiverFlow, syncNext bo
 		logs.Error("flow has been failed")
 		err := errors.New("flow has been failed")
 		headwaters.Cancel(err)
+		if !pa.attr.isInner {
+			// resume failure interrupted before atlantic
+			runFailure(headwaters)
+		}
 		return err
 
 	default:
@@ -170,12 +178,46 @@ func (pa *ParallelRiver) colorCurrent(color string) {
 	pa.color = color
 }
 
-func (pa *ParallelRiver) runRiver(headwaters *Headwaters, river Stream) {
-	if err := river.Run(headwaters, river.(RiverFlow), true); err != nil && err != ErrorCanceled {
-		headwaters.Cancel(err)
-	}
+func (pa *ParallelRiver) runRiver(headwaters *Headwaters, river Stream) error {
+	err := river.Run(headwaters, riverFlowOf(river), true)
 	//logs.Debug("one river done")
-	pa.wg.Done()
+	return err
+}
+
+// SetMaxConcurrency limits rivers running at a time, 0 means no limit
+func (pa *ParallelRiver) SetMaxConcurrency(n int) *ParallelRiver {
+	pa.option.MaxConcurrency = n
+	return pa
+}
+
+// SetFailPolicy sets how failed rivers are handled, FailFast by default
+func (pa *ParallelRiver) SetFailPolicy(policy FailPolicy) *ParallelRiver {
+	pa.option.Policy = policy
+	return pa
+}
+
+// SetQuorum sets Quorum policy, succeeds if at least n rivers succeed, n is in [1, rivers]
+func (pa *ParallelRiver) SetQuorum(n int) *ParallelRiver {
+	if n <= 0 {
+		panic("quorum must be positive")
+	}
+	pa.option.Policy = Quorum
+	pa.option.Quorum = n
+	return pa
+}
+
+// SetOutcomeKey sets the headwaters key of branch outcomes, see BranchOutcomes
+func (pa *ParallelRiver) SetOutcomeKey(key string) *ParallelRiver {
+	pa.option.OutcomeKey = key
+	return pa
+}
+
+func (pa *ParallelRiver) getOption() StreamOption {
+	return pa.option
+}
+
+func (pa *ParallelRiver) setOption(option StreamOption) {
+	pa.option = option
 }
 
 func (pa *ParallelRiver) Update(attr *RiverAttr) {
@@ -192,14 +234,13 @@ func (pa *ParallelRiver) Cycle(headwaters *Headwaters) (errCause string, err err
 	return "", nil
 }
 
+// Append adds a river running in parallel, it may be another parallel river. Nested rivers
+// share headwaters, failures of a nested one cancel its own rivers only.
 func (pa *ParallelRiver) Append(river Stream) *ParallelRiver {
 	if pa.rivers == nil {
 		pa.rivers = make([]Stream, 0)
 	}
 
-	if _, ok := river.(*ParallelRiver); ok {
-		panic("not supported river")
-	}
 	river.setInner()
 	for r := river.next(); r != nil; r = r.next() {
 		r.setInner()
@@ -219,14 +260,18 @@ func (pa *ParallelRiver) runInit(flow RiverFlow) {
 func (pa *ParallelRiver) runNext(headwaters *Headwaters, syncNext bool) error {
 	// do next
 	if pa.next() != nil {
+		if headwaters.eng().isShuttingDown() {
+			logs.Info("[%s][%s]unit is shutting down, stop before next", headwaters.RequestId, pa.color)
+			return ErrorShutdown
+		}
 		if syncNext {
-			return pa.next().Run(headwaters, pa.next().(RiverFlow), syncNext)
+			return pa.next().Run(headwaters, riverFlowOf(pa.next()), syncNext)
 		} else {
-			go pa.next().Run(headwaters, pa.next().(RiverFlow), syncNext)
+			headwaters.eng().goRun(pa.next(), headwaters, syncNext)
 		}
 	} else {
 		if !pa.attr.isInner {
-			headwaters.atlantic.runSuccess(headwaters, headwaters.atlantic.(AtlanticFlow))
+			headwaters.atlantic.runSuccess(headwaters, atlanticFlowOf(headwaters.atlantic))
 		}
 	}
 	return nil
@@ -242,11 +287,13 @@ func (pa *ParallelRiver) runFlow(headwaters *Headwaters, flow RiverFlow) error {
 		//logs.Debug("[%s][%s]run parallel river", headwaters.RequestId, pa.color)
 	}
 	// do run
-	for _, v := range pa.rivers {
-		pa.wg.Add(1)
-		go pa.runRiver(headwaters, v)
-	}
-	pa.wg.Wait()
+	outcomes, err := fanOut(headwaters, pa.rivers, pa.option, func(scope *Headwaters, i int) error {
+		return pa.runRiver(scope, pa.rivers[i])
+	})
+	headwaters.Put(BranchOutcomeKey(pa), outcomes)
 
-	return headwaters.Err()
+	if hwErr := headwaters.Err(); hwErr != nil {
+		return hwErr
+	}
+	return err
 }
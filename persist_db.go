@@ -4,6 +4,7 @@ import (
 	"github.com/astaxie/beego/orm"
 	"github.com/jack0liu/logs"
 	"github.com/jack0liu/utils"
+	"time"
 )
 
 const (
@@ -15,6 +16,8 @@ const (
 	flowTypeParallel = "multi"
 	flowTypeBasin    = "basin"
 	flowTypeAtlantic = "atlantic"
+	flowTypeChoice   = "choice"
+	flowTypeMap      = "map"
 
 	rootParent = "andes"
 )
@@ -27,6 +30,7 @@ type persistWater struct {
 	RequestId string
 	ReqInfo   interface{} // request info from andes
 	Atlantic  string
+	Deadline  time.Time
 
 	// basin context
 	BasinDone bool // must comes from basin
@@ -64,6 +68,20 @@ type VastFlow struct {
 	Error     string `orm:"null;type(text)"`
 	WaterId   string `orm:"size(64)"`
 	Deleted   int    `orm:"default(0)"`
+	// next retry or cycle attempt of a waiting river
+	NextAt time.Time `orm:"null;type(datetime);column(next_at)"`
+	// compensation state of a succeeded river after the andes failed
+	Compensation string `orm:"null;size(64)"`
+	// chosen branch of a choice river, or name of a branch under it
+	Branch string `orm:"null;size(128)"`
+	// json of StreamOption
+	Option string `orm:"null;type(text)"`
+	// request id of the andes started by a child river
+	ChildRequestId string `orm:"null;size(64)"`
+	// id of the child river started the andes, set on its root flow
+	ParentFlowId string `orm:"null;size(64)"`
+	// cancel error of a child andes, set on its root flow by the parent river
+	CancelErr string `orm:"null;type(text)"`
 }
 
 func init() {
@@ -72,60 +90,177 @@ func init() {
 	orm.RegisterModel(new(VastFlow))
 }
 
-func updateFlowState(flowId string, state string) error {
-	o := orm.NewOrm()
-	flow := VastFlow{
-		Id:    flowId,
-		State: state,
-	}
-	if _, err := o.Update(&flow, "state"); err != nil {
-		return err
-	}
-	return nil
+func updateFlowState(headwaters *Headwaters, flowId string, state string) error {
+	return fencedWrite(headwaters, func(o orm.Ormer) error {
+		flow := VastFlow{
+			Id:    flowId,
+			State: state,
+		}
+		if _, err := o.Update(&flow, "state"); err != nil {
+			return err
+		}
+		return nil
+	})
 }
 
-func setFlowEnd(flowId string, state string, err string) error {
-	o := orm.NewOrm()
-	flow := VastFlow{
-		Id:    flowId,
-		State: state,
-		EndAt: utils.GetCurrentTime(),
-		Error: err,
-	}
-	if _, err := o.Update(&flow, "state", "end_at", "error"); err != nil {
+func setFlowEnd(headwaters *Headwaters, flowId string, state string, err string) error {
+	return fencedWrite(headwaters, func(o orm.Ormer) error {
+		flow := VastFlow{
+			Id:    flowId,
+			State: state,
+			EndAt: utils.GetCurrentTime(),
+			Error: err,
+		}
+		if _, err := o.Update(&flow, "state", "end_at", "error"); err != nil {
+			return err
+		}
+		return nil
+	})
+}
+
+func setFlowNextAt(headwaters *Headwaters, flowId string, nextAt time.Time) error {
+	return fencedWrite(headwaters, func(o orm.Ormer) error {
+		flow := VastFlow{
+			Id:     flowId,
+			NextAt: nextAt,
+		}
+		if _, err := o.Update(&flow, "next_at"); err != nil {
+			return err
+		}
+		return nil
+	})
+}
+
+func clearFlowNextAt(headwaters *Headwaters, flowId string) error {
+	return fencedWrite(headwaters, func(o orm.Ormer) error {
+		_, err := o.QueryTable(new(VastFlow)).
+			Filter("id", flowId).
+			Update(orm.Params{"next_at": nil})
 		return err
-	}
-	return nil
+	})
 }
 
-func setFlowStart(flowId string, state string) error {
-	o := orm.NewOrm()
-	flow := VastFlow{
-		Id:      flowId,
-		State:   state,
-		BeginAt: utils.GetCurrentTime(),
-	}
-	if _, err := o.Update(&flow, "state", "begin_at"); err != nil {
+func setFlowCompensation(headwaters *Headwaters, flowId string, state string) error {
+	return fencedWrite(headwaters, func(o orm.Ormer) error {
+		flow := VastFlow{
+			Id:           flowId,
+			Compensation: state,
+		}
+		if _, err := o.Update(&flow, "compensation"); err != nil {
+			return err
+		}
+		return nil
+	})
+}
+
+func setFlowBranch(headwaters *Headwaters, flowId string, branch string) error {
+	return fencedWrite(headwaters, func(o orm.Ormer) error {
+		flow := VastFlow{
+			Id:     flowId,
+			Branch: branch,
+		}
+		if _, err := o.Update(&flow, "branch"); err != nil {
+			return err
+		}
+		return nil
+	})
+}
+
+func setFlowChild(headwaters *Headwaters, flowId string, childRequestId string) error {
+	return fencedWrite(headwaters, func(o orm.Ormer) error {
+		flow := VastFlow{
+			Id:             flowId,
+			ChildRequestId: childRequestId,
+		}
+		if _, err := o.Update(&flow, "child_request_id"); err != nil {
+			return err
+		}
+		return nil
+	})
+}
+
+// setAndesCancel marks the andes of requestId canceled, it's written under the job of headwaters
+func setAndesCancel(headwaters *Headwaters, requestId string, errStr string) error {
+	return fencedWrite(headwaters, func(o orm.Ormer) error {
+		_, err := o.QueryTable(new(VastFlow)).
+			Filter("request_id", requestId).
+			Filter("parent_id", rootParent).
+			Update(orm.Params{"cancel_err": errStr})
 		return err
-	}
-	return nil
+	})
+}
+
+func setFlowStart(headwaters *Headwaters, flowId string, state string) error {
+	return fencedWrite(headwaters, func(o orm.Ormer) error {
+		flow := VastFlow{
+			Id:      flowId,
+			State:   state,
+			BeginAt: utils.GetCurrentTime(),
+		}
+		if _, err := o.Update(&flow, "state", "begin_at"); err != nil {
+			return err
+		}
+		return nil
+	})
 }
 
 func updateHeadwaters(headwaters *Headwaters) error {
-	o := orm.NewOrm()
-	water := FlowWater{
-		Id:         headwaters.id,
-		Headwaters: toPersistWater(headwaters),
-		UpdateAt:   utils.GetCurrentTime(),
+	return fencedWrite(headwaters, func(o orm.Ormer) error {
+		water := FlowWater{
+			Id:         headwaters.id,
+			Headwaters: toPersistWater(headwaters),
+			UpdateAt:   utils.GetCurrentTime(),
+		}
+		if _, err := o.Update(&water, "headwaters", "update_at"); err != nil {
+			return err
+		}
+		return nil
+	})
+}
+
+// fencedWrite does write while holding the job row, it's rejected if the job has been
+// claimed again since headwaters took its fencing token
+func fencedWrite(headwaters *Headwaters, write func(o orm.Ormer) error) error {
+	e := headwaters.eng()
+	o := e.newOrm()
+	fence := headwaters.getFence()
+	if fence == 0 {
+		// not run as a job
+		return write(o)
+	}
+	if err := o.Begin(); err != nil {
+		logs.Error("db begin transaction fail")
+		return err
+	}
+	var job JobQueue
+	err := o.QueryTable("job_queue").
+		Filter("request_id", headwaters.jobRequestId()).
+		ForUpdate().
+		One(&job, "fence", "proc_unit")
+	if err != nil {
+		logs.Error("[%s]read job fence fail, err:%s", headwaters.RequestId, err.Error())
+		_ = o.Rollback()
+		return err
+	}
+	if job.Fence != fence || job.ProcUnit != e.unit {
+		logs.Error("[%s]stale fence %d of unit(%s), job fence %d of unit(%s)",
+			headwaters.RequestId, fence, e.unit, job.Fence, job.ProcUnit)
+		_ = o.Rollback()
+		return ErrorStaleFence
+	}
+	if err := write(o); err != nil {
+		_ = o.Rollback()
+		return err
 	}
-	if _, err := o.Update(&water, "headwaters", "update_at"); err != nil {
+	if err := o.Commit(); err != nil {
+		logs.Error("db commit transaction fail")
 		return err
 	}
 	return nil
 }
 
-func queryFlowById(flowId string) *VastFlow {
-	o := orm.NewOrm()
+func (e *Engine) queryFlowById(flowId string) *VastFlow {
+	o := e.newOrm()
 	vf := VastFlow{Id: flowId}
 	if err := o.Read(&vf); err != nil {
 		logs.Error("can't find andes flowId:%s", flowId)
@@ -134,9 +269,9 @@ func queryFlowById(flowId string) *VastFlow {
 	return &vf
 }
 
-func queryRootFlowByRequestId(requestId string) *VastFlow {
+func (e *Engine) queryRootFlowByRequestId(requestId string) *VastFlow {
 	var flows []*VastFlow
-	o := orm.NewOrm()
+	o := e.newOrm()
 	qs := o.QueryTable(new(VastFlow))
 	qs = qs.Filter("request_id", requestId)
 	qs = qs.Filter("parent_id", rootParent)
@@ -151,8 +286,8 @@ func queryRootFlowByRequestId(requestId string) *VastFlow {
 	return flows[0]
 }
 
-func queryWaterById(waterId string) *FlowWater {
-	o := orm.NewOrm()
+func (e *Engine) queryWaterById(waterId string) *FlowWater {
+	o := e.newOrm()
 	fw := FlowWater{Id: waterId}
 	if err := o.Read(&fw); err != nil {
 		logs.Error("can't find water waterId:%s", waterId)
@@ -161,9 +296,9 @@ func queryWaterById(waterId string) *FlowWater {
 	return &fw
 }
 
-func queryFlowByParentIdAndType(parentId, flowType string) []*VastFlow {
+func (e *Engine) queryFlowByParentIdAndType(parentId, flowType string) []*VastFlow {
 	var flows []*VastFlow
-	o := orm.NewOrm()
+	o := e.newOrm()
 	qs := o.QueryTable(new(VastFlow))
 	qs = qs.Filter("deleted", false) // used index
 	qs = qs.Filter("parent_id", parentId)
@@ -174,9 +309,9 @@ func queryFlowByParentIdAndType(parentId, flowType string) []*VastFlow {
 	return flows
 }
 
-func queryAtlanticByRequestId(requestId string) []*VastFlow {
+func (e *Engine) queryAtlanticByRequestId(requestId string) []*VastFlow {
 	var flows []*VastFlow
-	o := orm.NewOrm()
+	o := e.newOrm()
 	qs := o.QueryTable(new(VastFlow))
 	qs = qs.Filter("deleted", false) // used index
 	qs = qs.Filter("request_id", requestId)
@@ -187,9 +322,9 @@ func queryAtlanticByRequestId(requestId string) []*VastFlow {
 	return flows
 }
 
-func queryFlowByParentIdAndIndex(parentId string, index int) []*VastFlow {
+func (e *Engine) queryFlowByParentIdAndIndex(parentId string, index int) []*VastFlow {
 	var flows []*VastFlow
-	o := orm.NewOrm()
+	o := e.newOrm()
 	qs := o.QueryTable(new(VastFlow))
 	qs = qs.Filter("deleted", false) // used index
 	qs = qs.Filter("parent_id", parentId)
@@ -7,10 +7,15 @@ import (
 	"github.com/jack0liu/logs"
 	"github.com/satori/go.uuid"
 	"reflect"
+	"sort"
+	"strconv"
 	"sync"
+	"time"
 )
 
-func saveDraw(andes *Andes, initState streamState) (andesId string, err error) {
+var errNoFlow = errors.New("no flow drawn")
+
+func (e *Engine) saveDraw(andes *Andes, initState streamState) (andesId string, err error) {
 	requestId := andes.headwaters.RequestId
 	rivers := make([]Stream, 0)
 	rivers = append(rivers, andes.first)
@@ -24,9 +29,10 @@ func saveDraw(andes *Andes, initState streamState) (andesId string, err error) {
 		logs.Error("flows length is 0")
 		return "", err
 	}
+	flows[0].ParentFlowId = andes.parentFlowId
 
 	// db insert with transaction
-	o := orm.NewOrm()
+	o := e.newOrm()
 	if err := o.Begin(); err != nil {
 		logs.Error("db begin transaction fail")
 		return "", err
@@ -48,6 +54,62 @@ func saveDraw(andes *Andes, initState streamState) (andesId string, err error) {
 	return flows[0].Id, nil
 }
 
+// saveExpand saves items of a map river with their headwaters, and marks the map river expanded
+func saveExpand(headwaters *Headwaters, mapId string, items []Stream, waters []*Headwaters) error {
+	fws := make([]*FlowWater, 0)
+	flows := make([]*VastFlow, 0)
+	for i, item := range items {
+		hw := waters[i]
+		fws = append(fws, &FlowWater{
+			Id:         hw.id,
+			RequestId:  hw.RequestId,
+			Headwaters: toPersistWater(hw),
+		})
+		// the first flow built is the item
+		start := len(flows)
+		fws, flows = buildFlows(fws, flows, []Stream{item}, headwaters.RequestId, mapId, stateInit, 0, hw)
+		flows[start].Branch = strconv.Itoa(i)
+	}
+	write := func(o orm.Ormer) error {
+		if len(fws) > 0 {
+			if _, err := o.InsertMulti(10, fws); err != nil {
+				return err
+			}
+		}
+		if len(flows) > 0 {
+			if _, err := o.InsertMulti(20, flows); err != nil {
+				return err
+			}
+		}
+		flow := VastFlow{
+			Id:     mapId,
+			Branch: strconv.Itoa(len(items)),
+		}
+		if _, err := o.Update(&flow, "branch"); err != nil {
+			return err
+		}
+		return nil
+	}
+	if headwaters.getFence() > 0 {
+		// written in transaction
+		return fencedWrite(headwaters, write)
+	}
+	o := headwaters.eng().newOrm()
+	if err := o.Begin(); err != nil {
+		logs.Error("db begin transaction fail")
+		return err
+	}
+	if err := write(o); err != nil {
+		_ = o.Rollback()
+		return err
+	}
+	if err := o.Commit(); err != nil {
+		logs.Error("db commit transaction fail")
+		return err
+	}
+	return nil
+}
+
 func buildAtlantic(flows []*VastFlow, initState streamState, headwaters *Headwaters) []*VastFlow {
 	at := headwaters.atlantic
 	atlanticName := reflect.TypeOf(at).Elem().Name()
@@ -105,7 +167,7 @@ func buildFlows(waters []*FlowWater, flows []*VastFlow, rivers []Stream, request
 			logs.Debug("water requestId:%v", fw.RequestId)
 		}
 		switch v.(type) {
-		case *ParallelRiver:
+		case ParallelStream:
 			vf := &VastFlow{
 				Id:        currentId,
 				RequestId: requestId,
@@ -119,14 +181,19 @@ func buildFlows(waters []*FlowWater, flows []*VastFlow, rivers []Stream, request
 				Color:     v.GetColor(),
 				State:     initState.String(),
 				WaterId:   headwaters.id,
+				Option:    optionOf(v),
 			}
 			v.setId(vf.Id)
 			v.setWaterId(vf.WaterId)
 			v.setState(initState)
 			//logs.Debug("%v", vf)
 			flows = append(flows, vf)
-			pr := v.(*ParallelRiver)
-			waters, flows = buildFlows(waters, flows, pr.rivers, requestId, vf.Id, initState, 0, headwaters)
+			for i, river := range v.(ParallelStream).getRivers() {
+				// the first flow built is the river, its position is kept in Branch
+				start := len(flows)
+				waters, flows = buildFlows(waters, flows, []Stream{river}, requestId, vf.Id, initState, 0, headwaters)
+				flows[start].Branch = strconv.Itoa(i)
+			}
 		case *RiverBasin:
 			rb := v.(*RiverBasin)
 			vf := &VastFlow{
@@ -158,7 +225,54 @@ func buildFlows(waters []*FlowWater, flows []*VastFlow, rivers []Stream, request
 			waters = append(waters, fw)
 			logs.Debug("water:%v", fw)
 			waters, flows = buildFlows(waters, flows, rivers, requestId, vf.Id, initState, 0, newWater)
-
+		case ChoiceStream:
+			cs := v.(ChoiceStream)
+			vf := &VastFlow{
+				Id:        currentId,
+				RequestId: requestId,
+				ParentId:  parentId,
+				Index:     startIndex,
+				FlowType:  flowTypeChoice,
+				Name:      riverName,
+				ObjName:   objName,
+				ProjectId: projectId,
+				Action:    action,
+				Color:     v.GetColor(),
+				State:     initState.String(),
+				WaterId:   headwaters.id,
+			}
+			v.setId(vf.Id)
+			v.setWaterId(vf.WaterId)
+			v.setState(initState)
+			flows = append(flows, vf)
+			names, branches := cs.getBranches()
+			for i, branch := range branches {
+				// the first flow built is the branch
+				start := len(flows)
+				waters, flows = buildFlows(waters, flows, []Stream{branch}, requestId, vf.Id, initState, 0, headwaters)
+				flows[start].Branch = names[i]
+			}
+		case MapStream:
+			// items are built when expanded
+			vf := &VastFlow{
+				Id:        currentId,
+				RequestId: requestId,
+				ParentId:  parentId,
+				Index:     startIndex,
+				FlowType:  flowTypeMap,
+				Name:      riverName,
+				ObjName:   objName,
+				ProjectId: projectId,
+				Action:    action,
+				Color:     v.GetColor(),
+				State:     initState.String(),
+				WaterId:   headwaters.id,
+				Option:    optionOf(v),
+			}
+			v.setId(vf.Id)
+			v.setWaterId(vf.WaterId)
+			v.setState(initState)
+			flows = append(flows, vf)
 		default:
 			vf := &VastFlow{
 				Id:        currentId,
@@ -194,6 +308,8 @@ func toPersistWater(headwaters *Headwaters) string {
 	if headwaters == nil {
 		return ""
 	}
+	// scopes are not persisted, their water is
+	headwaters = headwaters.root()
 	basinDone := false
 	select {
 	case _, ok := <-headwaters.basinFinish():
@@ -230,6 +346,7 @@ func toPersistWater(headwaters *Headwaters) string {
 		RequestId: headwaters.RequestId,
 		ReqInfo:   headwaters.ReqInfo,
 		Atlantic:  atlanticName,
+		Deadline:  headwaters.deadline,
 
 		BasinDone: basinDone,
 		BasinErr:  basicErr,
@@ -249,7 +366,7 @@ func toPersistWater(headwaters *Headwaters) string {
 	return string(waterStr)
 }
 
-func fromPersistWater(waterStr string) *Headwaters {
+func (e *Engine) fromPersistWater(waterStr string) *Headwaters {
 	if len(waterStr) == 0 {
 		logs.Info("empty water skip")
 		return nil
@@ -259,7 +376,7 @@ func fromPersistWater(waterStr string) *Headwaters {
 		logs.Error("water str transfer persistErrorBasin fail, err:%s", err.Error())
 		return nil
 	}
-	stream := getAtlantic(pw.Atlantic)
+	stream := e.getAtlantic(pw.Atlantic)
 	if stream == nil {
 		logs.Error("water cant't find atlantic:%s", pw.Atlantic)
 		return nil
@@ -275,6 +392,8 @@ func fromPersistWater(waterStr string) *Headwaters {
 	headwaters.RequestId = pw.RequestId
 	headwaters.ReqInfo = pw.ReqInfo
 	headwaters.atlantic = atlantic
+	headwaters.deadline = pw.Deadline
+	headwaters.engine = e
 
 	// basin
 	headwaters.basinMu = &sync.Mutex{}
@@ -306,59 +425,117 @@ func fromPersistWater(waterStr string) *Headwaters {
 }
 
 func LoadAndesByRequestId(requestId string) *Andes {
-	flow := queryRootFlowByRequestId(requestId)
-	if flow == nil {
-		logs.Debug("not found requestId(%s) flow", requestId)
+	return defaultEngine.LoadAndesByRequestId(requestId)
+}
+
+func (e *Engine) LoadAndesByRequestId(requestId string) *Andes {
+	andes, err := e.loadAndesByRequestId(requestId)
+	if err != nil {
+		logs.Debug("load requestId(%s) flow fail, err:%s", requestId, err.Error())
 		return nil
 	}
-	logs.Debug("found requestId(%s) flow", requestId)
-	return load(flow)
+	return andes
 }
 
 func LoadAndes(flowId string) *Andes {
-	vf := queryFlowById(flowId)
+	return defaultEngine.LoadAndes(flowId)
+}
+
+func (e *Engine) LoadAndes(flowId string) *Andes {
+	vf := e.queryFlowById(flowId)
 	if vf == nil {
 		return nil
 	}
-	return load(vf)
+	andes, err := e.load(vf)
+	if err != nil {
+		return nil
+	}
+	return andes
 }
 
-func load(vf *VastFlow) *Andes {
-	fw := queryWaterById(vf.WaterId)
-	if fw == nil {
+// LoadChildAndes loads the andes started by the child river of flowId
+func LoadChildAndes(flowId string) *Andes {
+	return defaultEngine.LoadChildAndes(flowId)
+}
+
+func (e *Engine) LoadChildAndes(flowId string) *Andes {
+	vf := e.queryFlowById(flowId)
+	if vf == nil || len(vf.ChildRequestId) == 0 {
+		return nil
+	}
+	return e.LoadAndesByRequestId(vf.ChildRequestId)
+}
+
+// LoadParentAndes loads the andes whose child river started the andes of requestId
+func LoadParentAndes(requestId string) *Andes {
+	return defaultEngine.LoadParentAndes(requestId)
+}
+
+func (e *Engine) LoadParentAndes(requestId string) *Andes {
+	root := e.queryRootFlowByRequestId(requestId)
+	if root == nil || len(root.ParentFlowId) == 0 {
+		return nil
+	}
+	vf := e.queryFlowById(root.ParentFlowId)
+	if vf == nil {
 		return nil
 	}
+	return e.LoadAndesByRequestId(vf.RequestId)
+}
+
+func (e *Engine) loadAndesByRequestId(requestId string) (*Andes, error) {
+	flow := e.queryRootFlowByRequestId(requestId)
+	if flow == nil {
+		logs.Debug("not found requestId(%s) flow", requestId)
+		return nil, errNoFlow
+	}
+	logs.Debug("found requestId(%s) flow", requestId)
+	return e.load(flow)
+}
+
+func (e *Engine) load(vf *VastFlow) (*Andes, error) {
+	fw := e.queryWaterById(vf.WaterId)
+	if fw == nil {
+		return nil, errors.New("missed water:" + vf.WaterId)
+	}
 	if vf.ParentId != rootParent {
 		logs.Error("invalid andes flow:%s, parentId is:%s", vf.Id, vf.ParentId)
-		return nil
+		return nil, errors.New("invalid andes flow:" + vf.Id)
 	}
 	logs.Debug("load andes(%s) start", vf.Id)
 
 	// load atlantic and water
-	headwaters := fromPersistWater(fw.Headwaters)
-	atlantic := loadAtlantic(vf)
+	headwaters := e.fromPersistWater(fw.Headwaters)
+	if headwaters == nil {
+		return nil, errors.New("invalid water:" + vf.WaterId)
+	}
+	atlantic := e.loadAtlantic(vf)
+	if atlantic == nil {
+		return nil, errors.New("missed atlantic of request:" + vf.RequestId)
+	}
 	// load flow stream
-	stream, err := loadStream(vf, nil)
+	stream, err := e.loadStream(vf, nil)
 	if err != nil {
-		return nil
+		return nil, err
 	}
 
-	andes := &Andes{}
+	andes := e.NewAndes()
+	andes.parentFlowId = vf.ParentFlowId
 	andes.DrawStream(stream)
 	andes.DrawHeadWaters(headwaters)
 	andes.DrawAtlantic(atlantic)
 	logs.Debug("load andes(%s) end", vf.Id)
-	return andes
+	return andes, nil
 }
 
-func loadAtlantic(flow *VastFlow) AtlanticStream {
-	flows := queryAtlanticByRequestId(flow.RequestId)
+func (e *Engine) loadAtlantic(flow *VastFlow) AtlanticStream {
+	flows := e.queryAtlanticByRequestId(flow.RequestId)
 	if len(flows) == 0 {
 		logs.Error("not found atlantic, requestId:%s", flow.RequestId)
 		return nil
 	}
 	atlanticFlow := flows[0]
-	stream := getAtlantic(atlanticFlow.Name)
+	stream := e.getAtlantic(atlanticFlow.Name)
 	if stream == nil {
 		logs.Error("cant't find atlantic:%s", atlanticFlow.Name)
 		return nil
@@ -373,8 +550,8 @@ func loadAtlantic(flow *VastFlow) AtlanticStream {
 	return iStream.(AtlanticStream)
 }
 
-func loadStream(flow *VastFlow, parentStream Stream) (out Stream, err error) {
-	stream := getStream(flow.Name)
+func (e *Engine) loadStream(flow *VastFlow, parentStream Stream) (out Stream, err error) {
+	stream := e.getStream(flow.Name)
 	if stream == nil {
 		logs.Error("cant't find flow:%s", flow.Name)
 		return nil, errors.New("missed flow:" + flow.Name)
@@ -393,11 +570,11 @@ func loadStream(flow *VastFlow, parentStream Stream) (out Stream, err error) {
 			parentStream.SetDownStream(curStream)
 		}
 		setRiverInfo(curStream, flow)
-		nextFlows := queryFlowByParentIdAndIndex(flow.Id, flow.Index+1)
+		nextFlows := e.queryFlowByParentIdAndIndex(flow.Id, flow.Index+1)
 		if len(nextFlows) > 0 {
 			// only one next flow
 			next := nextFlows[0]
-			st, err := loadStream(next, curStream)
+			st, err := e.loadStream(next, curStream)
 			if err != nil {
 				return nil, err
 			}
@@ -420,18 +597,19 @@ func loadStream(flow *VastFlow, parentStream Stream) (out Stream, err error) {
 			parentStream.SetDownStream(curStream)
 		}
 
-		flows := queryFlowByParentIdAndIndex(flow.Id, 0)
+		flows := e.queryFlowByParentIdAndIndex(flow.Id, 0)
+		sortByBranch(flows)
 		for _, f := range flows {
-			st, err := loadStream(f, curStream)
+			st, err := e.loadStream(f, curStream)
 			if err != nil {
 				return nil, err
 			}
 			parallel.Append(st)
 		}
-		nextFlows := queryFlowByParentIdAndIndex(flow.Id, flow.Index+1)
+		nextFlows := e.queryFlowByParentIdAndIndex(flow.Id, flow.Index+1)
 		if len(nextFlows) > 0 {
 			next := nextFlows[0]
-			st, err := loadStream(next, curStream)
+			st, err := e.loadStream(next, curStream)
 			if err != nil {
 				return nil, err
 			}
@@ -453,9 +631,9 @@ func loadStream(flow *VastFlow, parentStream Stream) (out Stream, err error) {
 		}
 
 		// sub stream
-		flows := queryFlowByParentIdAndIndex(flow.Id, 0)
+		flows := e.queryFlowByParentIdAndIndex(flow.Id, 0)
 		for _, f := range flows {
-			st, err := loadStream(f, curStream)
+			st, err := e.loadStream(f, curStream)
 			if err != nil {
 				return nil, err
 			}
@@ -463,10 +641,93 @@ func loadStream(flow *VastFlow, parentStream Stream) (out Stream, err error) {
 		}
 
 		// next stream
-		nextFlows := queryFlowByParentIdAndIndex(flow.Id, flow.Index+1)
+		nextFlows := e.queryFlowByParentIdAndIndex(flow.Id, flow.Index+1)
 		if len(nextFlows) > 0 {
 			next := nextFlows[0]
-			st, err := loadStream(next, curStream)
+			st, err := e.loadStream(next, curStream)
+			if err != nil {
+				return nil, err
+			}
+			curStream.SetDownStream(st)
+		}
+
+		setRiverInfo(curStream, flow)
+		return curStream, nil
+	case flowTypeChoice:
+		logs.Debug("load choice river:%s, color:%s", flow.Name, flow.Color)
+		curStream, ok := iStream.(Stream)
+		if !ok {
+			logs.Error("new flow is not a Stream, name: %s", flow.Name)
+			return nil, errors.New("missed flow:" + flow.Name)
+		}
+		choice, ok := iStream.(ChoiceStream)
+		if !ok {
+			logs.Error("new flow is not a ChoiceRiver, name: %s", flow.Name)
+			return nil, errors.New("missed flow:" + flow.Name)
+		}
+		if parentStream != nil && flow.Index > 0 {
+			parentStream.SetDownStream(curStream)
+		}
+
+		// branches are drawn with the color of the choice river
+		curStream.colorCurrent(flow.Color)
+		flows := e.queryFlowByParentIdAndIndex(flow.Id, 0)
+		for _, f := range flows {
+			st, err := e.loadStream(f, curStream)
+			if err != nil {
+				return nil, err
+			}
+			choice.DrawBranch(f.Branch, st)
+		}
+		choice.setChosen(flow.Branch)
+		nextFlows := e.queryFlowByParentIdAndIndex(flow.Id, flow.Index+1)
+		if len(nextFlows) > 0 {
+			next := nextFlows[0]
+			st, err := e.loadStream(next, curStream)
+			if err != nil {
+				return nil, err
+			}
+			curStream.SetDownStream(st)
+		}
+
+		setRiverInfo(curStream, flow)
+		return curStream, nil
+	case flowTypeMap:
+		logs.Debug("load map river:%s, color:%s", flow.Name, flow.Color)
+		curStream, ok := iStream.(Stream)
+		if !ok {
+			logs.Error("new flow is not a Stream, name: %s", flow.Name)
+			return nil, errors.New("missed flow:" + flow.Name)
+		}
+		mapStream, ok := iStream.(MapStream)
+		if !ok {
+			logs.Error("new flow is not a MapRiver, name: %s", flow.Name)
+			return nil, errors.New("missed flow:" + flow.Name)
+		}
+		if parentStream != nil && flow.Index > 0 {
+			parentStream.SetDownStream(curStream)
+		}
+
+		// items are added with the color of the map river
+		curStream.colorCurrent(flow.Color)
+		flows := e.queryFlowByParentIdAndIndex(flow.Id, 0)
+		for _, f := range flows {
+			index, err := strconv.Atoi(f.Branch)
+			if err != nil {
+				logs.Error("invalid map item:%s, branch:%s", f.Id, f.Branch)
+				return nil, errors.New("invalid map item:" + f.Id)
+			}
+			st, err := e.loadStream(f, curStream)
+			if err != nil {
+				return nil, err
+			}
+			mapStream.addItem(index, st)
+		}
+		mapStream.setExpanded(len(flow.Branch) > 0)
+		nextFlows := e.queryFlowByParentIdAndIndex(flow.Id, flow.Index+1)
+		if len(nextFlows) > 0 {
+			next := nextFlows[0]
+			st, err := e.loadStream(next, curStream)
 			if err != nil {
 				return nil, err
 			}
@@ -482,11 +743,41 @@ func loadStream(flow *VastFlow, parentStream Stream) (out Stream, err error) {
 
 }
 
+// nextAtSetter is implemented by streams waiting between attempts
+type nextAtSetter interface {
+	setNextAt(nextAt time.Time)
+}
+
+// sortByBranch orders rivers of a parallel river by the position saved in Branch
+func sortByBranch(flows []*VastFlow) {
+	sort.SliceStable(flows, func(i, j int) bool {
+		bi, err := strconv.Atoi(flows[i].Branch)
+		if err != nil {
+			return false
+		}
+		bj, err := strconv.Atoi(flows[j].Branch)
+		if err != nil {
+			return false
+		}
+		return bi < bj
+	})
+}
+
 func setRiverInfo(s Stream, flow *VastFlow) {
 	s.setId(flow.Id)
 	s.colorCurrent(flow.Color)
 	s.setState(stateMap[flow.State])
 	s.setWaterId(flow.WaterId)
+	if ns, ok := s.(nextAtSetter); ok && !flow.NextAt.IsZero() {
+		ns.setNextAt(flow.NextAt)
+	}
+	if c, ok := s.(compensable); ok {
+		c.setCompensation(flow.Compensation)
+	}
+	setOptionInfo(s, flow.Option)
+	if cs, ok := s.(ChildStream); ok {
+		cs.setChild(flow.ChildRequestId)
+	}
 }
 
 func setAtlanticInfo(a AtlanticStream, flow *VastFlow) {
@@ -15,26 +15,32 @@ const (
 	JobRunning = "running"
 	JobFailed  = "failed"
 	JobSuccess = "success"
+	// job exceeded max attempts, it's not fetched again until requeued
+	JobDeadLetter = "dead_letter"
 
 	maxContinueCount = 10
-)
 
-var (
-	slowExpandCount = 0
+	DefaultMaxAttempts = 5
 )
 
 type JobQueue struct {
-	Id        string    `orm:"size(64);column(id);pk"`
-	RequestId string    `orm:"size(64)"`
-	Status    string    `orm:"size(64)"`
-	Action    string    `orm:"size(64)"`
-	ProjectId string    `orm:"size(64)"`
-	ObjectId  string    `orm:"null;size(64)"`
-	ProcUnit  string    `orm:"null;size(64)"`
-	CreateAt  time.Time `orm:"null;type(datetime);column(create_at)"`
-	UpdatedAt time.Time `orm:"null;type(datetime);column(updated_at)"`
-	EncToken  string    `orm:"null;type(text)"`
-	Request   string    `orm:"null;type(text)"`
+	Id        string `orm:"size(64);column(id);pk"`
+	RequestId string `orm:"size(64)"`
+	Status    string `orm:"size(64)"`
+	Action    string `orm:"size(64)"`
+	ProjectId string `orm:"size(64)"`
+	ObjectId  string `orm:"null;size(64)"`
+	ProcUnit  string `orm:"null;size(64)"`
+	Attempts  int    `orm:"default(0)"`
+	Fence     int64  `orm:"default(0)"`     // fencing token, increased every time the job is claimed
+	Labels    string `orm:"null;size(512)"` // labels required on unit, see JoinLabels
+	// owner must renew it before expired, otherwise the job is reclaimed
+	LeaseExpireAt time.Time `orm:"null;type(datetime);column(lease_expire_at)"`
+	CreateAt      time.Time `orm:"null;type(datetime);column(create_at)"`
+	UpdatedAt     time.Time `orm:"null;type(datetime);column(updated_at)"`
+	Deadline      time.Time `orm:"null;type(datetime);column(deadline)"`
+	EncToken      string    `orm:"null;type(text)"`
+	Request       string    `orm:"null;type(text)"`
 }
 
 func (sys *JobQueue) TableName() string {
@@ -47,9 +53,13 @@ func init() {
 }
 
 func SaveJob(c JobQueue, o orm.Ormer) (id string, err error) {
+	return defaultEngine.SaveJob(c, o)
+}
+
+func (e *Engine) SaveJob(c JobQueue, o orm.Ormer) (id string, err error) {
 	if o == nil {
 		logs.Info("o is nil")
-		o = orm.NewOrm()
+		o = e.newOrm()
 	}
 	c.Id = strings.Replace(uuid.NewV4().String(), "-", "", -1)
 	c.CreateAt = time.Now().UTC()
@@ -64,8 +74,12 @@ func SaveJob(c JobQueue, o orm.Ormer) (id string, err error) {
 }
 
 func GetJobByRequestId(requestId string) (job *JobQueue, err error) {
+	return defaultEngine.GetJobByRequestId(requestId)
+}
+
+func (e *Engine) GetJobByRequestId(requestId string) (job *JobQueue, err error) {
 	var jqs []*JobQueue
-	o := orm.NewOrm()
+	o := e.newOrm()
 	_, err = o.QueryTable("job_queue").
 		Filter("request_id", requestId).
 		All(&jqs)
@@ -85,17 +99,27 @@ func GetJobByRequestId(requestId string) (job *JobQueue, err error) {
 }
 
 func GetOneWaitingJob(unit string) (job *JobQueue, err error) {
-	job, err = fetchWaitingJobByUnit(unit)
+	return defaultEngine.GetOneWaitingJob(unit)
+}
+
+func (e *Engine) GetOneWaitingJob(unit string) (job *JobQueue, err error) {
+	if e.isShuttingDown() {
+		return nil, ErrorShutdown
+	}
+	if e.isFenced() {
+		return nil, ErrorStaleFence
+	}
+	job, err = e.fetchWaitingJobByUnit(unit)
 	if job != nil {
 		return
 	}
 	if err == orm.ErrNoRows {
 		// no row found
-		job, err = fetchWaitingJobByUnit("")
+		job, err = e.fetchWaitingJobByUnit("")
 		if job == nil {
 			return nil, err
 		}
-		o := orm.NewOrm()
+		o := e.newOrm()
 		num, err := o.QueryTable("job_queue").
 			Filter("id", job.Id).
 			Filter("proc_unit", ""). // avoid other update this
@@ -117,42 +141,35 @@ func GetOneWaitingJob(unit string) (job *JobQueue, err error) {
 	return nil, err
 }
 
-func fetchWaitingJobByUnit(unit string) (job *JobQueue, err error) {
-	var j JobQueue
-	o := orm.NewOrm()
-	err = o.QueryTable("job_queue").
-		Filter("status", JobWaiting).
-		Filter("proc_unit", unit).
-		OrderBy("updated_at").
-		Limit(1).
-		One(&j)
+func (e *Engine) fetchWaitingJobByUnit(unit string) (job *JobQueue, err error) {
+	o := e.newOrm()
+	j, err := e.pickWaitingJob(o, unit)
 	if err != nil {
 		return nil, err
 	}
-	flowWnd.Lock()
-	defer flowWnd.Unlock()
-	if flowWnd.Remains() <= 0 {
-		errStr := fmt.Sprintf("not have enough wnd, curSize:%d, total capacity:%d",
-			flowWnd.CurSize, flowWnd.Capacity+flowWnd.extended)
-		logs.Info(errStr)
-		if flowWnd.IsBelowMark() {
-			slowExpandCount++
-			if slowExpandCount >= maxContinueCount {
-				flowWnd.Extend(defaultExtendLen)
-			}
-		} else {
-			logs.Info("over mark, clean count")
-			slowExpandCount = 0
-		}
-		return nil, errors.New(errStr)
+	e.wnd.Lock()
+	defer e.wnd.Unlock()
+	if err := e.admit(); err != nil {
+		e.wnd.rejected++
+		return nil, err
+	}
+	if !e.wnd.canAcquire(j.Action) {
+		e.wnd.rejected++
+		return nil, fmt.Errorf("no wnd slot for action(%s)", j.Action)
+	}
+	now, err := e.dbNow()
+	if err != nil {
+		return nil, err
 	}
-	slowExpandCount = 0
 	num, err := o.QueryTable("job_queue").
 		Filter("id", j.Id).
 		Filter("status", JobWaiting). // avoid other update this
 		Update(orm.Params{
-			"status":     JobRunning,
-			"updated_at": time.Now().UTC(),
+			"status":          JobRunning,
+			"attempts":        orm.ColValue(orm.ColAdd, 1),
+			"fence":           orm.ColValue(orm.ColAdd, 1),
+			"lease_expire_at": now.Add(e.leaseDuration()),
+			"updated_at":      time.Now().UTC(),
 		})
 	if err != nil {
 		logs.Info("can't update status, err:%s", err.Error())
@@ -162,12 +179,86 @@ func fetchWaitingJobByUnit(unit string) (job *JobQueue, err error) {
 		logs.Info("update job nothing, not get waiting job, next")
 		return nil, nil
 	}
-	flowWnd.Inc()
-	return &j, nil
+	j.Status = JobRunning
+	j.Attempts++
+	j.Fence++
+	e.wnd.acquire(j.RequestId, j.Action)
+	e.wnd.claimed++
+	return j, nil
+}
+
+// pickWaitingJob gets the oldest waiting job bound to unit, or in pool if unit is empty.
+// a job in pool is picked only if this unit has all its labels
+func (e *Engine) pickWaitingJob(o orm.Ormer, unit string) (*JobQueue, error) {
+	if len(unit) > 0 {
+		var j JobQueue
+		qs, err := e.poolScope(o.QueryTable("job_queue"))
+		if err != nil {
+			return nil, err
+		}
+		err = qs.Filter("status", JobWaiting).
+			Filter("proc_unit", unit).
+			OrderBy("updated_at").
+			Limit(1).
+			One(&j)
+		if err != nil {
+			return nil, err
+		}
+		return &j, nil
+	}
+	// scan until the pool is exhausted, pages follow the last job seen so none is skipped
+	labels := e.unitLabels()
+	var last *JobQueue
+	for {
+		var jobs []*JobQueue
+		qs := o.QueryTable("job_queue")
+		if last != nil {
+			qs = qs.SetCond(orm.NewCondition().
+				Or("updated_at__gt", last.UpdatedAt).
+				OrCond(orm.NewCondition().And("updated_at", last.UpdatedAt).And("id__gt", last.Id)))
+		}
+		qs, err := e.poolScope(qs)
+		if err != nil {
+			return nil, err
+		}
+		_, err = qs.Filter("status", JobWaiting).
+			Filter("proc_unit", "").
+			OrderBy("updated_at", "id").
+			Limit(labelScanSize).
+			All(&jobs)
+		if err != nil {
+			return nil, err
+		}
+		for _, j := range jobs {
+			if labelsSatisfied(j.Labels, labels) {
+				return j, nil
+			}
+		}
+		if len(jobs) < labelScanSize {
+			return nil, orm.ErrNoRows
+		}
+		last = jobs[len(jobs)-1]
+	}
+}
+
+// poolScope limits the query to jobs which can get a slot of the window
+func (e *Engine) poolScope(qs orm.QuerySeter) (orm.QuerySeter, error) {
+	e.wnd.RLock()
+	defer e.wnd.RUnlock()
+	return e.wnd.poolScope(qs)
 }
 
 func SetRunningJobFailed(jobId string) error {
-	o := orm.NewOrm()
+	return defaultEngine.SetRunningJobFailed(jobId)
+}
+
+func (e *Engine) SetRunningJobFailed(jobId string) error {
+	o := e.newOrm()
+	job := JobQueue{Id: jobId}
+	if err := o.Read(&job); err != nil {
+		logs.Info("can't read job(%s), err:%s", jobId, err.Error())
+		return err
+	}
 	num, err := o.QueryTable("job_queue").
 		Filter("id", jobId).
 		Filter("status", JobRunning). // avoid other update this
@@ -183,14 +274,18 @@ func SetRunningJobFailed(jobId string) error {
 		logs.Info("update running job nothing.")
 		return nil
 	}
-	flowWnd.Lock()
-	flowWnd.Dec()
-	flowWnd.Unlock()
+	e.wnd.Lock()
+	e.wnd.release(job.RequestId)
+	e.wnd.Unlock()
 	return nil
 }
 
 func UpdateJobStatus(jobId, status string) error {
-	o := orm.NewOrm()
+	return defaultEngine.UpdateJobStatus(jobId, status)
+}
+
+func (e *Engine) UpdateJobStatus(jobId, status string) error {
+	o := e.newOrm()
 	job := JobQueue{
 		Id:        jobId,
 		Status:    status,
@@ -203,17 +298,70 @@ func UpdateJobStatus(jobId, status string) error {
 	return nil
 }
 
+// finishJob sets final status of the job, it's rejected if headwaters has a stale fencing token
+func finishJob(headwaters *Headwaters, status string) error {
+	if headwaters.jobRequestId() != headwaters.RequestId {
+		// child andes, the job is finished by its parent
+		return nil
+	}
+	e := headwaters.eng()
+	o := e.newOrm()
+	qs := o.QueryTable("job_queue").
+		Filter("request_id", headwaters.RequestId)
+	fence := headwaters.getFence()
+	if fence > 0 {
+		qs = qs.Filter("fence", fence).Filter("proc_unit", e.unit)
+	}
+	num, err := qs.Update(orm.Params{
+		"status":          status,
+		"lease_expire_at": nil,
+		"updated_at":      time.Now().UTC(),
+	})
+	if err != nil {
+		logs.Error("[%s]finish job fail,%s", headwaters.RequestId, err.Error())
+		return err
+	}
+	if num == 0 && fence > 0 {
+		logs.Error("[%s]stale fence %d, job not finished", headwaters.RequestId, fence)
+		return ErrorStaleFence
+	}
+	return nil
+}
+
+func (e *Engine) setJobDeadline(jobId string, deadline time.Time) error {
+	o := e.newOrm()
+	job := JobQueue{
+		Id:       jobId,
+		Deadline: deadline,
+	}
+	if _, err := o.Update(&job, "deadline"); err != nil {
+		logs.Error("update job deadline fail,%s", err.Error())
+		return err
+	}
+	return nil
+}
+
+// UnSetJobUnit releases running jobs of a dead unit which are not held by lease,
+// leased jobs are reclaimed one by one when their lease expires
 func UnSetJobUnit(unit string, o orm.Ormer) error {
+	return defaultEngine.UnSetJobUnit(unit, o)
+}
+
+func (e *Engine) UnSetJobUnit(unit string, o orm.Ormer) error {
 	if o == nil {
-		o = orm.NewOrm()
+		o = e.newOrm()
 	}
-	num, err := o.QueryTable("job_queue").
+	qs := o.QueryTable("job_queue").
 		Filter("status", JobRunning).
 		Filter("proc_unit", unit).
-		Update(orm.Params{
-			"proc_unit": "",
-			"status":    JobWaiting,
-		})
+		Filter("lease_expire_at__isnull", true)
+	if err := e.deadLetterJobs(qs, "unit("+unit+")"); err != nil {
+		return err
+	}
+	num, err := qs.Update(orm.Params{
+		"proc_unit": "",
+		"status":    JobWaiting,
+	})
 	if err != nil {
 		logs.Error("update fail err:%s", err.Error())
 		return err
@@ -222,8 +370,122 @@ func UnSetJobUnit(unit string, o orm.Ormer) error {
 	return nil
 }
 
-func transJobStatusByUnit(unit, fromStatus, toStatus string) error {
-	o := orm.NewOrm()
+// releaseUnitJobs hands running and waiting jobs of unit back to the pool,
+// a released running job gets its attempt back since it didn't fail
+func (e *Engine) releaseUnitJobs(unit string) error {
+	o := e.newOrm()
+	if err := o.Begin(); err != nil {
+		logs.Error("db begin transaction fail")
+		return err
+	}
+	if _, err := o.QueryTable("job_queue").
+		Filter("status", JobRunning).
+		Filter("proc_unit", unit).
+		Filter("attempts__gt", 0).
+		Update(orm.Params{
+			"attempts": orm.ColValue(orm.ColMinus, 1),
+		}); err != nil {
+		logs.Error("release attempts of unit(%s) fail, err:%s", unit, err.Error())
+		_ = o.Rollback()
+		return err
+	}
+	num, err := o.QueryTable("job_queue").
+		Filter("status__in", JobRunning, JobWaiting).
+		Filter("proc_unit", unit).
+		Update(orm.Params{
+			"proc_unit":       "",
+			"status":          JobWaiting,
+			"lease_expire_at": nil,
+			"updated_at":      time.Now().UTC(),
+		})
+	if err != nil {
+		logs.Error("release jobs of unit(%s) fail, err:%s", unit, err.Error())
+		_ = o.Rollback()
+		return err
+	}
+	if err := o.Commit(); err != nil {
+		logs.Error("db commit transaction fail")
+		return err
+	}
+	logs.Info("release jobs of unit(%s) num %d", unit, num)
+	return nil
+}
+
+// renewJobLeases extends lease of every running job of unit separately,
+// so one failed write only risks that job
+func (e *Engine) renewJobLeases(unit string) {
+	var jobs []*JobQueue
+	o := e.newOrm()
+	_, err := o.QueryTable("job_queue").
+		Filter("status", JobRunning).
+		Filter("proc_unit", unit).
+		All(&jobs, "id")
+	if err != nil {
+		logs.Error("query leased jobs fail, err:%s", err.Error())
+		return
+	}
+	now, err := e.dbNow()
+	if err != nil {
+		return
+	}
+	expireAt := now.Add(e.leaseDuration())
+	for _, j := range jobs {
+		num, err := o.QueryTable("job_queue").
+			Filter("id", j.Id).
+			Filter("status", JobRunning).
+			Filter("proc_unit", unit). // avoid renew a reclaimed job
+			Update(orm.Params{
+				"lease_expire_at": expireAt,
+			})
+		if err != nil {
+			logs.Warn("renew lease of job(%s) fail, err:%s", j.Id, err.Error())
+			continue
+		}
+		if num == 0 {
+			logs.Warn("lease of job(%s) lost", j.Id)
+		}
+	}
+}
+
+// reclaimExpiredJobs puts running jobs whose lease expired back to waiting, with recovery
+// enabled only the ones no unit adopted in the grace
+func (e *Engine) reclaimExpiredJobs() error {
+	now, err := e.dbNow()
+	if err != nil {
+		return err
+	}
+	o := e.newOrm()
+	qs := o.QueryTable("job_queue").
+		Filter("status", JobRunning).
+		Filter("lease_expire_at__lt", now)
+	if err := e.deadLetterJobs(qs, "expired lease"); err != nil {
+		return err
+	}
+	if e.autoRecover {
+		// units adopt expired jobs on heart, only the ones left for a while go back to waiting
+		grace := time.Duration(adoptGraceTimes*e.intervalSec) * time.Second
+		qs = o.QueryTable("job_queue").
+			Filter("status", JobRunning).
+			Filter("lease_expire_at__lt", now.Add(-grace))
+	}
+	num, err := qs.Update(orm.Params{
+		"proc_unit":       "",
+		"status":          JobWaiting,
+		"lease_expire_at": nil,
+		"updated_at":      time.Now().UTC(),
+	})
+	if err != nil {
+		logs.Error("reclaim expired jobs fail, err:%s", err.Error())
+		return err
+	}
+	if num > 0 {
+		logs.Info("reclaim expired jobs num %d", num)
+	}
+	return nil
+}
+
+func (e *Engine) transJobStatusByUnit(unit, fromStatus, toStatus string) error {
+	o := e.newOrm()
 	num, err := o.QueryTable("job_queue").
 		Filter("proc_unit", unit).
 		Filter("status", fromStatus). // avoid other update this
@@ -242,3 +504,111 @@ func transJobStatusByUnit(unit, fromStatus, toStatus string) error {
 	logs.Debug("trans job num:%d", num)
 	return nil
 }
+
+// SetMaxJobAttempts sets how many times a job can be fetched before moving to dead letter, 0 means no limit
+func SetMaxJobAttempts(attempts int) {
+	defaultEngine.SetMaxJobAttempts(attempts)
+}
+
+func (e *Engine) SetMaxJobAttempts(attempts int) {
+	if attempts < 0 {
+		attempts = 0
+	}
+	e.maxJobAttempts = attempts
+}
+
+// deadLetterJobsByUnit moves unit's running jobs which used up their attempts to dead letter,
+// proc unit is kept to show where it failed last
+func (e *Engine) deadLetterJobsByUnit(unit string, o orm.Ormer) error {
+	if o == nil {
+		o = e.newOrm()
+	}
+	qs := o.QueryTable("job_queue").
+		Filter("status", JobRunning).
+		Filter("proc_unit", unit)
+	return e.deadLetterJobs(qs, "unit("+unit+")")
+}
+
+func (e *Engine) deadLetterJobs(qs orm.QuerySeter, owner string) error {
+	if e.maxJobAttempts <= 0 {
+		return nil
+	}
+	num, err := qs.
+		Filter("attempts__gte", e.maxJobAttempts).
+		Update(orm.Params{
+			"status":          JobDeadLetter,
+			"lease_expire_at": nil,
+			"updated_at":      time.Now().UTC(),
+		})
+	if err != nil {
+		logs.Error("dead letter jobs of %s fail, err:%s", owner, err.Error())
+		return err
+	}
+	if num > 0 {
+		logs.Warn("dead letter jobs of %s num %d", owner, num)
+	}
+	return nil
+}
+
+func ListDeadLetterJobs(offset, limit int) (jobs []*JobQueue, err error) {
+	return defaultEngine.ListDeadLetterJobs(offset, limit)
+}
+
+func (e *Engine) ListDeadLetterJobs(offset, limit int) (jobs []*JobQueue, err error) {
+	o := e.newOrm()
+	_, err = o.QueryTable("job_queue").
+		Filter("status", JobDeadLetter).
+		OrderBy("-updated_at").
+		Limit(limit, offset).
+		All(&jobs)
+	if err != nil {
+		logs.Error("list dead letter jobs fail, err:%s", err.Error())
+		return nil, err
+	}
+	return jobs, nil
+}
+
+func GetDeadLetterJob(jobId string) (job *JobQueue, err error) {
+	return defaultEngine.GetDeadLetterJob(jobId)
+}
+
+func (e *Engine) GetDeadLetterJob(jobId string) (job *JobQueue, err error) {
+	var j JobQueue
+	o := e.newOrm()
+	err = o.QueryTable("job_queue").
+		Filter("id", jobId).
+		Filter("status", JobDeadLetter).
+		One(&j)
+	if err != nil {
+		logs.Error("get dead letter job(%s) fail, err:%s", jobId, err.Error())
+		return nil, err
+	}
+	return &j, nil
+}
+
+// RequeueDeadLetterJob puts a dead letter job back to waiting with attempts reset
+func RequeueDeadLetterJob(jobId string) error {
+	return defaultEngine.RequeueDeadLetterJob(jobId)
+}
+
+func (e *Engine) RequeueDeadLetterJob(jobId string) error {
+	o := e.newOrm()
+	num, err := o.QueryTable("job_queue").
+		Filter("id", jobId).
+		Filter("status", JobDeadLetter). // avoid other update this
+		Update(orm.Params{
+			"status":     JobWaiting,
+			"proc_unit":  "",
+			"attempts":   0,
+			"updated_at": time.Now().UTC(),
+		})
+	if err != nil {
+		logs.Error("requeue job(%s) fail, err:%s", jobId, err.Error())
+		return err
+	}
+	if num == 0 {
+		return errors.New("job is not in dead letter")
+	}
+	logs.Info("requeue dead letter job(%s)", jobId)
+	return nil
+}
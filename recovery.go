@@ -0,0 +1,208 @@
+package vastflow
+
+import (
+	"github.com/astaxie/beego/orm"
+	"github.com/jack0liu/logs"
+	"time"
+)
+
+type RecoveryFailure struct {
+	JobId     string
+	RequestId string
+	Reason    string
+}
+
+type RecoveryReport struct {
+	Unit      string
+	Recovered []string // request ids resumed from persisted rivers
+	Requeued  []string // request ids never drawn, back to waiting
+	Failed    []*RecoveryFailure
+}
+
+// EnableRecovery makes the unit resume in-flight andes by itself, on start and when
+// adopting jobs whose lease expired. handler gets every report, it can be nil.
+// Must be called before StartHeart.
+func EnableRecovery(handler func(report *RecoveryReport)) {
+	defaultEngine.EnableRecovery(handler)
+}
+
+func (e *Engine) EnableRecovery(handler func(report *RecoveryReport)) {
+	e.autoRecover = true
+	e.recoveryHandler = handler
+}
+
+// RecoverJobs resumes andes of unit's running jobs, the ones can't be restored go to dead letter
+func RecoverJobs(unit string) *RecoveryReport {
+	return defaultEngine.RecoverJobs(unit)
+}
+
+func (e *Engine) RecoverJobs(unit string) *RecoveryReport {
+	report := &RecoveryReport{Unit: unit}
+	var jobs []*JobQueue
+	o := e.newOrm()
+	_, err := o.QueryTable("job_queue").
+		Filter("status", JobRunning).
+		Filter("proc_unit", unit).
+		All(&jobs)
+	if err != nil {
+		logs.Error("query jobs of unit(%s) fail, err:%s", unit, err.Error())
+		return report
+	}
+	now, err := e.dbNow()
+	if err != nil {
+		return report
+	}
+	for _, job := range jobs {
+		num, err := o.QueryTable("job_queue").
+			Filter("id", job.Id).
+			Filter("status", JobRunning).
+			Filter("proc_unit", unit). // avoid other update this
+			Update(orm.Params{
+				"attempts":        orm.ColValue(orm.ColAdd, 1),
+				"fence":           orm.ColValue(orm.ColAdd, 1),
+				"lease_expire_at": now.Add(e.leaseDuration()),
+				"updated_at":      time.Now().UTC(),
+			})
+		if err != nil || num == 0 {
+			logs.Info("job(%s) is not owned by unit(%s) any more", job.Id, unit)
+			continue
+		}
+		e.recoverJob(job, report)
+	}
+	return report
+}
+
+// adoptExpiredJobs takes expired jobs as many as the admission of this unit allows and resumes
+// them here, every unit adopts on heart, jobs used up their attempts are left to dead letter
+func (e *Engine) adoptExpiredJobs(unit string) *RecoveryReport {
+	report := &RecoveryReport{Unit: unit}
+	now, err := e.dbNow()
+	if err != nil {
+		return report
+	}
+	var jobs []*JobQueue
+	o := e.newOrm()
+	qs := o.QueryTable("job_queue").
+		Filter("status", JobRunning).
+		Filter("lease_expire_at__lt", now)
+	if e.maxJobAttempts > 0 {
+		qs = qs.Filter("attempts__lt", e.maxJobAttempts)
+	}
+	_, err = qs.OrderBy("updated_at").
+		Limit(labelScanSize).
+		All(&jobs)
+	if err != nil {
+		logs.Error("query expired jobs fail, err:%s", err.Error())
+		return report
+	}
+	labels := e.unitLabels()
+	for _, job := range jobs {
+		if !labelsSatisfied(job.Labels, labels) {
+			continue
+		}
+		e.wnd.Lock()
+		err := e.admit()
+		slotted := e.wnd.canAcquire(job.Action)
+		e.wnd.Unlock()
+		if err != nil {
+			logs.Info("unit(%s) stops adopting, %s", unit, err.Error())
+			break
+		}
+		if !slotted {
+			continue
+		}
+		num, err := o.QueryTable("job_queue").
+			Filter("id", job.Id).
+			Filter("status", JobRunning).
+			Filter("lease_expire_at__lt", now). // avoid other update this
+			Update(orm.Params{
+				"proc_unit":       unit,
+				"attempts":        orm.ColValue(orm.ColAdd, 1),
+				"fence":           orm.ColValue(orm.ColAdd, 1),
+				"lease_expire_at": now.Add(e.leaseDuration()),
+				"updated_at":      time.Now().UTC(),
+			})
+		if err != nil || num == 0 {
+			logs.Info("job(%s) adopted by others", job.Id)
+			continue
+		}
+		logs.Info("unit(%s) adopt job(%s) from unit(%s)", unit, job.Id, job.ProcUnit)
+		job.ProcUnit = unit
+		e.recoverJob(job, report)
+	}
+	return report
+}
+
+func (e *Engine) recoverJob(job *JobQueue, report *RecoveryReport) {
+	andes, err := e.loadAndesByRequestId(job.RequestId)
+	if err == errNoFlow {
+		// not drawn yet, the application draws it when fetching again
+		_ = e.requeueJob(job.Id)
+		report.Requeued = append(report.Requeued, job.RequestId)
+		return
+	}
+	if err != nil {
+		e.failRecovery(job, err.Error(), report)
+		return
+	}
+	if at := e.queryFlowById(andes.headwaters.atlantic.getId()); at != nil {
+		switch at.State {
+		case stateSuccess.String():
+			_ = e.UpdateJobStatus(job.Id, JobSuccess)
+			report.Recovered = append(report.Recovered, job.RequestId)
+			return
+		case stateFail.String():
+			_ = e.UpdateJobStatus(job.Id, JobFailed)
+			report.Recovered = append(report.Recovered, job.RequestId)
+			return
+		}
+	}
+	e.wnd.Lock()
+	e.wnd.acquire(job.RequestId, job.Action)
+	e.wnd.Unlock()
+	if err := andes.ReStart(); err != nil {
+		e.wnd.Lock()
+		e.wnd.release(job.RequestId)
+		e.wnd.Unlock()
+		e.failRecovery(job, err.Error(), report)
+		return
+	}
+	report.Recovered = append(report.Recovered, job.RequestId)
+}
+
+// requeueJob puts the job back to waiting of its unit, its lease is dropped
+func (e *Engine) requeueJob(jobId string) error {
+	o := e.newOrm()
+	if _, err := o.QueryTable("job_queue").
+		Filter("id", jobId).
+		Update(orm.Params{
+			"status":          JobWaiting,
+			"lease_expire_at": nil,
+			"updated_at":      time.Now().UTC(),
+		}); err != nil {
+		logs.Error("requeue job(%s) fail, err:%s", jobId, err.Error())
+		return err
+	}
+	return nil
+}
+
+func (e *Engine) failRecovery(job *JobQueue, reason string, report *RecoveryReport) {
+	logs.Error("recover job(%s) request(%s) fail, reason:%s", job.Id, job.RequestId, reason)
+	_ = e.UpdateJobStatus(job.Id, JobDeadLetter)
+	report.Failed = append(report.Failed, &RecoveryFailure{
+		JobId:     job.Id,
+		RequestId: job.RequestId,
+		Reason:    reason,
+	})
+}
+
+func (e *Engine) reportRecovery(report *RecoveryReport) {
+	if len(report.Recovered) == 0 && len(report.Requeued) == 0 && len(report.Failed) == 0 {
+		return
+	}
+	logs.Info("unit(%s) recovery, recovered:%d, requeued:%d, failed:%d",
+		report.Unit, len(report.Recovered), len(report.Requeued), len(report.Failed))
+	if e.recoveryHandler != nil {
+		e.recoveryHandler(report)
+	}
+}
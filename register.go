@@ -6,48 +6,66 @@ import (
 	"reflect"
 )
 
-var streamTypes = make(map[string]reflect.Type)
+func RegisterStream(stream Stream) {
+	defaultEngine.RegisterStream(stream)
+}
 
-var atlanticTypes = make(map[string]reflect.Type)
+func RegisterAtlantic(atlantic AtlanticStream) {
+	defaultEngine.RegisterAtlantic(atlantic)
+}
 
-func RegisterStream(stream Stream) {
+func (e *Engine) RegisterStream(stream Stream) {
 	if stream == nil {
 		panic("vastflow:Register stream is nil")
 	}
 	streamName := reflect.TypeOf(stream).Elem().Name()
 	logs.Debug("register stream: %s", streamName)
-	if _, ok := streamTypes[streamName]; ok {
+	e.registerMu.Lock()
+	defer e.registerMu.Unlock()
+	if _, ok := e.streamTypes[streamName]; ok {
 		panic(fmt.Sprintf("vastflow:RegisterStream is dumplicated, name:%q", streamName))
 	}
-	streamTypes[streamName] = reflect.TypeOf(stream).Elem()
+	e.streamTypes[streamName] = reflect.TypeOf(stream).Elem()
 }
 
-func RegisterAtlantic(atlantic AtlanticStream) {
+func (e *Engine) RegisterAtlantic(atlantic AtlanticStream) {
 	if atlantic == nil {
 		panic("vastflow:Register atlantic is nil")
 	}
 	atlanticName := reflect.TypeOf(atlantic).Elem().Name()
 	logs.Debug("register atlantic:%s", atlanticName)
-	if _, ok := atlanticTypes[atlanticName]; ok {
+	e.registerMu.Lock()
+	defer e.registerMu.Unlock()
+	if _, ok := e.atlanticTypes[atlanticName]; ok {
 		panic(fmt.Sprintf("vastflow:RegisterAtlantic is dumplicated, name:%q", atlanticName))
 	}
-	atlanticTypes[atlanticName] = reflect.TypeOf(atlantic).Elem()
+	e.atlanticTypes[atlanticName] = reflect.TypeOf(atlantic).Elem()
 }
 
-func getStream(name string) reflect.Type {
-	if st, ok := streamTypes[name]; ok {
+func (e *Engine) getStream(name string) reflect.Type {
+	e.registerMu.RLock()
+	st, ok := e.streamTypes[name]
+	e.registerMu.RUnlock()
+	if ok {
 		return st
-	} else {
-		logs.Error("not found stream :%s", name)
-		return nil
 	}
+	if e != defaultEngine {
+		return defaultEngine.getStream(name)
+	}
+	logs.Error("not found stream :%s", name)
+	return nil
 }
 
-func getAtlantic(name string) reflect.Type {
-	if at, ok := atlanticTypes[name]; ok {
+func (e *Engine) getAtlantic(name string) reflect.Type {
+	e.registerMu.RLock()
+	at, ok := e.atlanticTypes[name]
+	e.registerMu.RUnlock()
+	if ok {
 		return at
-	} else {
-		logs.Error("not found atlantic :%s", name)
-		return nil
 	}
+	if e != defaultEngine {
+		return defaultEngine.getAtlantic(name)
+	}
+	logs.Error("not found atlantic :%s", name)
+	return nil
 }
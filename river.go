@@ -4,7 +4,6 @@ import (
 	"errors"
 	"fmt"
 	"github.com/jack0liu/logs"
-	"reflect"
 	"time"
 )
 
@@ -13,6 +12,10 @@ var (
 	ErrorCanceled      = errors.New("river canceled to run")
 	ErrorBasinCanceled = errors.New("basin canceled to run")
 	ErrorContinue      = errors.New("river needs to continue")
+	ErrorDeadline      = errors.New("andes deadline exceeded")
+	ErrorShutdown      = errors.New("unit is shutting down")
+	ErrorStaleFence    = errors.New("stale fencing token, job is owned by others")
+	ErrorTimeout       = errors.New("river call timeout")
 )
 
 type RiverFlow interface {
@@ -30,6 +33,26 @@ type RiverAttr struct {
 	//seconds
 	CycleInterval int32
 
+	// how retry and cycle intervals grow, constant by default
+	Backoff BackoffPolicy
+	// seconds, limits the interval grown by backoff, 0 means no limit
+	MaxInterval int32
+	// ratio in [0, 1], the interval is randomly shortened by up to this ratio
+	Jitter float64
+
+	// take place of the seconds above if not zero
+	RetryDelay time.Duration
+	CycleDelay time.Duration
+	MaxDelay   time.Duration
+
+	// a call of Flow or Cycle longer than these is abandoned, 0 means no limit.
+	// ContextRiverFlow also gets them as deadline of the context, canceled once the call is abandoned.
+	FlowTimeout  time.Duration
+	CycleTimeout time.Duration
+	// timeout flow is retried and timeout cycle continues, otherwise the river fails with ErrorTimeout.
+	// only for ContextRiverFlow, an abandoned call of RiverFlow may still run, so it always fails.
+	RetryOnTimeout bool
+
 	Durable bool
 
 	Atomic bool
@@ -49,45 +72,48 @@ type River struct {
 
 	retryCount int32
 	cycleCount int32
+	nextAt     time.Time // next attempt time restored from db
+
+	compensation string
 }
 
 func (an *River) setFail(errStr string, flow RiverFlow, headwaters *Headwaters) error {
 	logs.Info("[%s][%s]fail", headwaters.RequestId, an.color)
 	an.state = stateFail
 	an.errStr = errStr
-	cause := fmt.Sprintf("%v:%s", reflect.ValueOf(flow).Elem().Type(), errStr)
-	if err := setFlowEnd(an.id, stateFail.String(), cause); err != nil {
+	cause := fmt.Sprintf("%v:%s", flowType(flow), errStr)
+	if err := setFlowEnd(headwaters, an.id, stateFail.String(), cause); err != nil {
 		logs.Error("update state fail, err:%s", err.Error())
 		return err
 	}
 	if !an.attr.isInner {
 		headwaters.Cancel(errors.New(errStr))
-		headwaters.atlantic.runFail(headwaters, headwaters.atlantic.(AtlanticFlow))
+		runFailure(headwaters)
 	}
 	return errors.New(cause)
 }
 
-func (an *River) setSuccess() error {
+func (an *River) setSuccess(headwaters *Headwaters) error {
 	an.state = stateSuccess
-	if err := setFlowEnd(an.id, stateSuccess.String(), ""); err != nil {
+	if err := setFlowEnd(headwaters, an.id, stateSuccess.String(), ""); err != nil {
 		logs.Error("update state fail, err:%s", err.Error())
 		return err
 	}
 	return nil
 }
 
-func (an *River) setRunning() error {
+func (an *River) setRunning(headwaters *Headwaters) error {
 	an.state = stateRunning
-	if err := setFlowStart(an.id, stateRunning.String()); err != nil {
+	if err := setFlowStart(headwaters, an.id, stateRunning.String()); err != nil {
 		logs.Error("update state fail, err:%s", err.Error())
 		return err
 	}
 	return nil
 }
 
-func (an *River) setCycling() error {
+func (an *River) setCycling(headwaters *Headwaters) error {
 	an.state = stateCycling
-	if err := updateFlowState(an.id, stateCycling.String()); err != nil {
+	if err := updateFlowState(headwaters, an.id, stateCycling.String()); err != nil {
 		logs.Error("update state fail, err:%s", err.Error())
 		return err
 	}
@@ -106,22 +132,84 @@ func (an *River) innerFlow(headwaters *Headwaters, flow RiverFlow) (errCause str
 	select {
 	case <-headwaters.basinFinish():
 		if an.attr.Atomic {
-			return flow.Flow(headwaters)
+			return an.callFlow(headwaters, flow)
 		} else {
 			return "", ErrorBasinCanceled
 		}
 	case <-headwaters.Done():
 		if an.attr.Atomic {
-			return flow.Flow(headwaters)
+			return an.callFlow(headwaters, flow)
 		} else {
 			return "", ErrorCanceled
 		}
 	default:
-		return flow.Flow(headwaters)
+		return an.callFlow(headwaters, flow)
+	}
+}
+
+func (an *River) callFlow(headwaters *Headwaters, flow RiverFlow) (errCause string, err error) {
+	if _, ok := flow.(*contextRiverFlow); !ok {
+		return callTimeout(headwaters, an.attr.FlowTimeout, flow.Flow)
+	}
+	// timeout is the deadline of context too, an abandoned call sees it canceled before retry
+	errCause, err = flow.Flow(headwaters)
+	if err == ErrorTimeout && an.attr.RetryOnTimeout {
+		return errCause, ErrorRetry
+	}
+	return errCause, err
+}
+
+func (an *River) callCycle(headwaters *Headwaters, flow RiverFlow) (errCause string, err error) {
+	if _, ok := flow.(*contextRiverFlow); !ok {
+		return callTimeout(headwaters, an.attr.CycleTimeout, flow.Cycle)
+	}
+	errCause, err = flow.Cycle(headwaters)
+	if err == ErrorTimeout && an.attr.RetryOnTimeout {
+		return errCause, ErrorContinue
+	}
+	return errCause, err
+}
+
+// callTimeout abandons call after timeout, the call goes on in background until it returns,
+// and is counted as running until then, so shutdown waits for it
+func callTimeout(headwaters *Headwaters, timeout time.Duration,
+	call func(headwaters *Headwaters) (string, error)) (errCause string, err error) {
+	if timeout <= 0 {
+		return call(headwaters)
+	}
+	type result struct {
+		errCause string
+		err      error
+	}
+	ch := make(chan result, 1)
+	e := headwaters.eng()
+	e.enterRun()
+	go func() {
+		defer e.leaveRun()
+		defer func() {
+			if e := recover(); e != nil {
+				logs.Error("[%s]%v", headwaters.RequestId, e)
+				PrintStack()
+				ch <- result{"got an panic", errors.New("got an panic")}
+			}
+		}()
+		errCause, err := call(headwaters)
+		ch <- result{errCause, err}
+	}()
+	t := time.NewTimer(timeout)
+	defer t.Stop()
+	select {
+	case r := <-ch:
+		return r.errCause, r.err
+	case <-t.C:
+		logs.Warn("[%s]call timeout after %s", headwaters.RequestId, timeout.String())
+		return fmt.Sprintf("call timeout after %s", timeout.String()), ErrorTimeout
 	}
 }
 
 func (an *River) Run(headwaters *Headwaters, flow RiverFlow, syncNext bool) (err error) {
+	headwaters.eng().enterRun()
+	defer headwaters.eng().leaveRun()
 	//logs.Info("[%s][%s]%v run start, id :%s", headwaters.RequestId, an.color, reflect.ValueOf(flow).Elem().Type(), an.id)
 	defer func() {
 		if e := recover(); e != nil {
@@ -134,12 +222,15 @@ func (an *River) Run(headwaters *Headwaters, flow RiverFlow, syncNext bool) (err
 	an.runInit(flow)
 	switch an.state {
 	case stateInit:
-		if err = an.setRunning(); err != nil {
+		if err = an.setRunning(headwaters); err != nil {
 			return err
 		}
 		fallthrough
 	case stateRunning:
 		if err = an.runFlow(headwaters, flow, syncNext); err != nil {
+			if err == ErrorShutdown {
+				return err
+			}
 			if err := an.setFail(err.Error(), flow, headwaters); err != nil {
 				return err
 			}
@@ -152,18 +243,21 @@ func (an *River) Run(headwaters *Headwaters, flow RiverFlow, syncNext bool) (err
 		}
 		if an.attr.CycleTimes <= 0 {
 			// no cycle, set success , then do next
-			if err = an.setSuccess(); err != nil {
+			if err = an.setSuccess(headwaters); err != nil {
 				return err
 			}
 			return an.runNext(headwaters, syncNext)
 		}
 		// do cycle
-		if err = an.setCycling(); err != nil {
+		if err = an.setCycling(headwaters); err != nil {
 			return err
 		}
 		fallthrough
 	case stateCycling:
 		if err = an.runCycle(headwaters, flow); err != nil {
+			if err == ErrorShutdown {
+				return err
+			}
 			if err := an.setFail(err.Error(), flow, headwaters); err != nil {
 				return err
 			}
@@ -174,7 +268,7 @@ func (an *River) Run(headwaters *Headwaters, flow RiverFlow, syncNext bool) (err
 				return err
 			}
 		}
-		if err = an.setSuccess(); err != nil {
+		if err = an.setSuccess(headwaters); err != nil {
 			return err
 		}
 		fallthrough
@@ -185,6 +279,10 @@ func (an *River) Run(headwaters *Headwaters, flow RiverFlow, syncNext bool) (err
 		logs.Error("[%s][%s]flow has been failed", headwaters.RequestId, an.color)
 		err = errors.New("flow has been failed")
 		headwaters.Cancel(err)
+		if !an.attr.isInner {
+			// resume failure interrupted before atlantic
+			runFailure(headwaters)
+		}
 		return err
 
 	default:
@@ -246,7 +344,10 @@ func (an *River) doRetry(headwaters *Headwaters, flow RiverFlow) (errStr string,
 	var eStr string
 	for an.retryCount < an.attr.RetryTimes {
 		logs.Debug("[%s][%s]retry count : %d", headwaters.RequestId, an.color, an.retryCount)
-		time.Sleep(time.Duration(an.attr.RetryInterval) * time.Second)
+		an.wait(headwaters, an.attr.retryInterval(), an.retryCount)
+		if headwaters.eng().isShuttingDown() {
+			return "", ErrorShutdown
+		}
 		eStr, err = an.innerFlow(headwaters, flow)
 		if err != nil {
 			an.retryCount++
@@ -264,26 +365,26 @@ func (an *River) doRetry(headwaters *Headwaters, flow RiverFlow) (errStr string,
 }
 
 func (an *River) doCycle(headwaters *Headwaters, flow RiverFlow) (errStr string, err error) {
-	if err := an.setCycling(); err != nil {
+	if err := an.setCycling(headwaters); err != nil {
 		return err.Error(), err
 	}
 	for an.cycleCount < an.attr.CycleTimes {
-		time.Sleep(time.Duration(an.attr.CycleInterval) * time.Second)
+		an.wait(headwaters, an.attr.cycleInterval(), an.cycleCount)
 		select {
 		case <-headwaters.basinFinish():
 			if an.attr.Atomic {
-				errStr, err = flow.Cycle(headwaters)
+				errStr, err = an.callCycle(headwaters, flow)
 			} else {
 				return "basin canceled", ErrorCanceled
 			}
 		case <-headwaters.Done():
 			if an.attr.Atomic {
-				errStr, err = flow.Cycle(headwaters)
+				errStr, err = an.callCycle(headwaters, flow)
 			} else {
 				return "river canceled", ErrorCanceled
 			}
 		default:
-			errStr, err = flow.Cycle(headwaters)
+			errStr, err = an.callCycle(headwaters, flow)
 		}
 		if err == nil {
 			//out set success
@@ -299,6 +400,65 @@ func (an *River) doCycle(headwaters *Headwaters, flow RiverFlow) (errStr string,
 	return errStr, errors.New(errStr)
 }
 
+// wait sleeps before attempt n by backoff of base interval, the next attempt time is
+// saved so a restored river waits the rest of it
+func (an *River) wait(headwaters *Headwaters, base time.Duration, n int32) {
+	e := headwaters.eng()
+	var d time.Duration
+	saved := false
+	if !an.nextAt.IsZero() {
+		d = an.nextAt.Sub(e.dbTime())
+		an.nextAt = time.Time{}
+		saved = true
+	} else {
+		d = an.attr.backoff(base, n)
+		if d >= time.Second {
+			if err := setFlowNextAt(headwaters, an.id, e.dbTime().Add(d)); err != nil {
+				logs.Warn("[%s][%s]save next attempt time fail, err:%s", headwaters.RequestId, an.color, err.Error())
+			} else {
+				saved = true
+			}
+		}
+	}
+	if d > 0 {
+		an.sleep(headwaters, d)
+	}
+	if saved && !e.isShuttingDown() {
+		// waited, a river restored later must not reuse it
+		if err := clearFlowNextAt(headwaters, an.id); err != nil {
+			logs.Warn("[%s][%s]clear next attempt time fail, err:%s", headwaters.RequestId, an.color, err.Error())
+		}
+	}
+}
+
+func (an *River) getCompensation() string {
+	return an.compensation
+}
+
+func (an *River) setCompensation(state string) {
+	an.compensation = state
+}
+
+func (an *River) setNextAt(nextAt time.Time) {
+	an.nextAt = nextAt
+}
+
+// sleep waits for d, a canceled headwaters wakes it up unless the river is atomic
+func (an *River) sleep(headwaters *Headwaters, d time.Duration) {
+	if an.attr.Atomic {
+		time.Sleep(d)
+		return
+	}
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-t.C:
+	case <-headwaters.Done():
+	case <-headwaters.basinFinish():
+	case <-headwaters.eng().stopping:
+	}
+}
+
 func (an *River) runInit(flow RiverFlow) {
 	flow.Update(&an.attr)
 }
@@ -306,14 +466,18 @@ func (an *River) runInit(flow RiverFlow) {
 func (an *River) runNext(headwaters *Headwaters, syncNext bool) error {
 	// do next
 	if an.next() != nil {
+		if headwaters.eng().isShuttingDown() {
+			logs.Info("[%s][%s]unit is shutting down, stop before next", headwaters.RequestId, an.color)
+			return ErrorShutdown
+		}
 		if syncNext {
-			return an.next().Run(headwaters, an.next().(RiverFlow), syncNext)
+			return an.next().Run(headwaters, riverFlowOf(an.next()), syncNext)
 		} else {
-			go an.next().Run(headwaters, an.next().(RiverFlow), syncNext)
+			headwaters.eng().goRun(an.next(), headwaters, syncNext)
 		}
 	} else {
 		if !an.attr.isInner {
-			headwaters.atlantic.runSuccess(headwaters, headwaters.atlantic.(AtlanticFlow))
+			headwaters.atlantic.runSuccess(headwaters, atlanticFlowOf(headwaters.atlantic))
 		}
 	}
 	return nil
@@ -323,22 +487,25 @@ func (an *River) runCycle(headwaters *Headwaters, flow RiverFlow) error {
 	var errStr string
 	var err error
 	for an.cycleCount < an.attr.CycleTimes {
-		time.Sleep(time.Duration(an.attr.CycleInterval) * time.Second)
+		an.wait(headwaters, an.attr.cycleInterval(), an.cycleCount)
+		if headwaters.eng().isShuttingDown() {
+			return ErrorShutdown
+		}
 		select {
 		case <-headwaters.basinFinish():
 			if an.attr.Atomic {
-				errStr, err = flow.Cycle(headwaters)
+				errStr, err = an.callCycle(headwaters, flow)
 			} else {
 				return ErrorCanceled
 			}
 		case <-headwaters.Done():
 			if an.attr.Atomic {
-				errStr, err = flow.Cycle(headwaters)
+				errStr, err = an.callCycle(headwaters, flow)
 			} else {
 				return ErrorCanceled
 			}
 		default:
-			errStr, err = flow.Cycle(headwaters)
+			errStr, err = an.callCycle(headwaters, flow)
 		}
 		if err == nil {
 			//out set success
@@ -349,7 +516,7 @@ func (an *River) runCycle(headwaters *Headwaters, flow RiverFlow) error {
 			an.cycleCount++
 			continue
 		}
-		logs.Info("[%s][%s]%v cycle err:%s", headwaters.RequestId, an.color, reflect.ValueOf(flow).Elem().Type(), err.Error())
+		logs.Info("[%s][%s]%v cycle err:%s", headwaters.RequestId, an.color, flowType(flow), err.Error())
 		return err
 	}
 	errStr = fmt.Sprintf("[%s][%s]cycle %d times failed, cause:%s", headwaters.RequestId, an.color, an.cycleCount, errStr)
@@ -357,19 +524,26 @@ func (an *River) runCycle(headwaters *Headwaters, flow RiverFlow) error {
 }
 
 func (an *River) runFlow(headwaters *Headwaters, flow RiverFlow, b bool) error {
+	if !an.nextAt.IsZero() {
+		// restored while waiting for a retry
+		an.wait(headwaters, 0, 0)
+	}
 	// do run
 	errStr, err := an.innerFlow(headwaters, flow)
 	if err == nil {
 		return nil
 	}
 	if err != ErrorRetry {
-		logs.Error("[%s][%s]%v run failed, err: %s", headwaters.RequestId, an.color, reflect.ValueOf(flow).Elem().Type(), err.Error())
+		logs.Error("[%s][%s]%v run failed, err: %s", headwaters.RequestId, an.color, flowType(flow), err.Error())
 		return err
 	}
 	if an.attr.RetryTimes <= 0 {
 		return errors.New(errStr)
 	}
 	errStr, err = an.doRetry(headwaters, flow)
+	if err == ErrorShutdown {
+		return err
+	}
 	if err != nil {
 		return errors.New(errStr)
 	}
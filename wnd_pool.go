@@ -0,0 +1,203 @@
+package vastflow
+
+import (
+	"errors"
+	"fmt"
+	"github.com/astaxie/beego/orm"
+	"github.com/jack0liu/logs"
+)
+
+// wndPool reserves slots of the window for jobs of one action
+type wndPool struct {
+	capacity int64
+	borrow   bool // takes slots from the shared pool when the reserved are used up
+	used     int64
+	borrowed int64
+}
+
+type wndSlot struct {
+	pool     string // empty means the shared pool
+	borrowed bool
+}
+
+type PoolStats struct {
+	Capacity int64
+	Borrow   bool
+	Used     int64 // reserved slots in use
+	Borrowed int64 // shared slots in use
+}
+
+// SetWndPool reserves capacity slots of the window for jobs whose action is name, the others
+// share what's left. capacity 0 removes the pool, its running jobs keep their slots as shared ones.
+func SetWndPool(name string, capacity int64, borrow bool) error {
+	return defaultEngine.SetWndPool(name, capacity, borrow)
+}
+
+func (e *Engine) SetWndPool(name string, capacity int64, borrow bool) error {
+	if len(name) == 0 {
+		return errors.New("pool name is empty")
+	}
+	if capacity < 0 {
+		return errors.New("capacity is negative")
+	}
+	fw := e.wnd
+	fw.Lock()
+	defer fw.Unlock()
+	if capacity == 0 {
+		fw.removePool(name)
+		return nil
+	}
+	reserved := fw.reserved() + capacity
+	if p, ok := fw.pools[name]; ok {
+		reserved -= p.capacity
+	}
+	if reserved > fw.Capacity {
+		return fmt.Errorf("pools reserve %d slots, more than capacity %d", reserved, fw.Capacity)
+	}
+	if p, ok := fw.pools[name]; ok {
+		p.capacity = capacity
+		p.borrow = borrow
+	} else {
+		fw.pools[name] = &wndPool{capacity: capacity, borrow: borrow}
+	}
+	logs.Info("wnd pool(%s) capacity:%d, borrow:%v", name, capacity, borrow)
+	return nil
+}
+
+// removePool moves slots in use of the pool to the shared pool, borrowed ones are counted there already
+func (fw *FlowWnd) removePool(name string) {
+	p, ok := fw.pools[name]
+	if !ok {
+		return
+	}
+	delete(fw.pools, name)
+	fw.sharedUsed += p.used
+	for _, slot := range fw.slots {
+		if slot.pool == name {
+			slot.pool = ""
+			slot.borrowed = false
+		}
+	}
+	logs.Info("wnd pool(%s) removed, %d slots in use moved to shared", name, p.used)
+}
+
+// reserved is slots reserved by all pools
+func (fw *FlowWnd) reserved() int64 {
+	var reserved int64
+	for _, p := range fw.pools {
+		reserved += p.capacity
+	}
+	return reserved
+}
+
+func (fw *FlowWnd) sharedRemains() int64 {
+	shared := fw.Capacity + fw.extended
+	for _, p := range fw.pools {
+		shared -= p.capacity
+	}
+	return shared - fw.sharedUsed
+}
+
+// canAcquire tells if a job of action gets a slot
+func (fw *FlowWnd) canAcquire(action string) bool {
+	if p, ok := fw.pools[action]; ok {
+		if p.used < p.capacity {
+			return true
+		}
+		if !p.borrow {
+			return false
+		}
+	}
+	return fw.sharedRemains() > 0
+}
+
+// acquire takes a slot for the request, reserved slots of its pool go first
+func (fw *FlowWnd) acquire(requestId, action string) {
+	if _, ok := fw.slots[requestId]; ok {
+		return
+	}
+	slot := &wndSlot{}
+	if p, ok := fw.pools[action]; ok {
+		slot.pool = action
+		if p.used < p.capacity {
+			p.used++
+		} else {
+			slot.borrowed = true
+			p.borrowed++
+			fw.sharedUsed++
+		}
+	} else {
+		fw.sharedUsed++
+	}
+	fw.slots[requestId] = slot
+	fw.Inc()
+}
+
+// release gives back the slot of the request, nothing happens if it has no slot
+func (fw *FlowWnd) release(requestId string) {
+	slot, ok := fw.slots[requestId]
+	if !ok {
+		return
+	}
+	delete(fw.slots, requestId)
+	p := fw.pools[slot.pool]
+	switch {
+	case p != nil && slot.borrowed:
+		decFloor(&p.borrowed)
+		decFloor(&fw.sharedUsed)
+	case p != nil:
+		decFloor(&p.used)
+	case len(slot.pool) == 0 || slot.borrowed:
+		decFloor(&fw.sharedUsed)
+	}
+	fw.Dec()
+}
+
+// decFloor decreases a count of slots in use, never below zero
+func decFloor(n *int64) {
+	if *n > 0 {
+		*n--
+	}
+}
+
+// poolScope limits the query to actions which can get a slot, it returns an error if none can
+func (fw *FlowWnd) poolScope(qs orm.QuerySeter) (orm.QuerySeter, error) {
+	if len(fw.pools) == 0 {
+		return qs, nil
+	}
+	if fw.sharedRemains() > 0 {
+		full := make([]string, 0)
+		for name, p := range fw.pools {
+			if p.used >= p.capacity && !p.borrow {
+				full = append(full, name)
+			}
+		}
+		if len(full) > 0 {
+			qs = qs.Exclude("action__in", full)
+		}
+		return qs, nil
+	}
+	free := make([]string, 0)
+	for name, p := range fw.pools {
+		if p.used < p.capacity {
+			free = append(free, name)
+		}
+	}
+	if len(free) == 0 {
+		return nil, errors.New("all wnd pools are full")
+	}
+	return qs.Filter("action__in", free), nil
+}
+
+func (fw *FlowWnd) poolStats() map[string]PoolStats {
+	stats := make(map[string]PoolStats, len(fw.pools))
+	for name, p := range fw.pools {
+		stats[name] = PoolStats{
+			Capacity: p.capacity,
+			Borrow:   p.borrow,
+			Used:     p.used,
+			Borrowed: p.borrowed,
+		}
+	}
+	return stats
+}
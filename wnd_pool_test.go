@@ -0,0 +1,28 @@
+package vastflow
+
+import "testing"
+
+func TestWndPoolRemoveInUse(t *testing.T) {
+	fw := newFlowWnd()
+	fw.Capacity = 4
+	fw.pools["create"] = &wndPool{capacity: 2, borrow: true}
+	for _, req := range []string{"r1", "r2", "r3"} {
+		fw.acquire(req, "create")
+	}
+	fw.removePool("create")
+	if fw.sharedUsed != 3 {
+		t.Fatalf("shared used %d after removing pool, want 3", fw.sharedUsed)
+	}
+	if fw.sharedRemains() != 1 {
+		t.Fatalf("shared remains %d, want 1", fw.sharedRemains())
+	}
+	// a pool with the same name doesn't take the old slots back
+	fw.pools["create"] = &wndPool{capacity: 2}
+	for _, req := range []string{"r1", "r2", "r3"} {
+		fw.release(req)
+	}
+	p := fw.pools["create"]
+	if fw.sharedUsed != 0 || p.used != 0 || p.borrowed != 0 {
+		t.Fatalf("after release shared used %d, pool used %d borrowed %d", fw.sharedUsed, p.used, p.borrowed)
+	}
+}